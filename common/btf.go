@@ -0,0 +1,610 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const BTF_MAGIC = 0xeB9F
+
+const (
+	BTF_KIND_UNKN = iota
+	BTF_KIND_INT
+	BTF_KIND_PTR
+	BTF_KIND_ARRAY
+	BTF_KIND_STRUCT
+	BTF_KIND_UNION
+	BTF_KIND_ENUM
+	BTF_KIND_FWD
+	BTF_KIND_TYPEDEF
+	BTF_KIND_VOLATILE
+	BTF_KIND_CONST
+	BTF_KIND_RESTRICT
+	BTF_KIND_FUNC
+	BTF_KIND_FUNC_PROTO
+	BTF_KIND_VAR
+	BTF_KIND_DATASEC
+	BTF_KIND_FLOAT
+	BTF_KIND_DECL_TAG
+	BTF_KIND_TYPE_TAG
+	BTF_KIND_ENUM64
+)
+
+const (
+	BTF_INT_SIGNED = 1 << 0
+	BTF_INT_CHAR   = 1 << 1
+	BTF_INT_BOOL   = 1 << 2
+)
+
+const btfMaxResolveDepth = 32
+
+type btfHeader struct {
+	Magic   uint16
+	Version uint8
+	Flags   uint8
+	HdrLen  uint32
+	TypeOff uint32
+	TypeLen uint32
+	StrOff  uint32
+	StrLen  uint32
+}
+
+type BTFMember struct {
+	Name string
+	Type uint32
+	// BitOffset is the offset of the member from the start of its struct,
+	// and BitSize is non-zero for bitfields.
+	BitOffset uint32
+	BitSize   uint32
+}
+
+type BTFParam struct {
+	Name string
+	Type uint32
+}
+
+type BTFEnumValue struct {
+	Name  string
+	Value int64
+}
+
+type BTFType struct {
+	Name     string
+	Kind     int
+	KindFlag bool
+	Vlen     int
+	// Size is used by INT, ENUM, STRUCT, UNION, DATASEC and FLOAT,
+	// Type by the other kinds which refer to another type.
+	Size uint32
+	Type uint32
+
+	IntEncoding uint8
+	IntOffset   uint8
+	IntBits     uint8
+
+	ArrayType   uint32
+	ArrayNelems uint32
+
+	Members    []BTFMember
+	Params     []BTFParam
+	EnumValues []BTFEnumValue
+}
+
+type BTF struct {
+	types  []*BTFType
+	byName map[string][]uint32
+}
+
+func LoadVmlinuxBTF() (*BTF, error) {
+	data, err := os.ReadFile("/sys/kernel/btf/vmlinux")
+	if err != nil {
+		return nil, err
+	}
+	return ParseBTF(data)
+}
+
+func ParseBTF(data []byte) (*BTF, error) {
+	var hdr btfHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Magic != BTF_MAGIC {
+		return nil, fmt.Errorf("invalid btf magic: %#x", hdr.Magic)
+	}
+	typeStart := uint64(hdr.HdrLen) + uint64(hdr.TypeOff)
+	strStart := uint64(hdr.HdrLen) + uint64(hdr.StrOff)
+	if typeStart+uint64(hdr.TypeLen) > uint64(len(data)) || strStart+uint64(hdr.StrLen) > uint64(len(data)) {
+		return nil, errors.New("btf sections are out of bounds")
+	}
+	strs := data[strStart : strStart+uint64(hdr.StrLen)]
+	name := func(off uint32) string {
+		if int(off) >= len(strs) {
+			return ""
+		}
+		end := bytes.IndexByte(strs[off:], 0)
+		if end < 0 {
+			return string(strs[off:])
+		}
+		return string(strs[off : int(off)+end])
+	}
+
+	b := &BTF{
+		types:  []*BTFType{{Name: "void"}},
+		byName: map[string][]uint32{},
+	}
+	r := bytes.NewReader(data[typeStart : typeStart+uint64(hdr.TypeLen)])
+	read := func() uint32 {
+		var v uint32
+		/* a short read is caught by the check of r.Len() below */
+		_ = binary.Read(r, binary.LittleEndian, &v)
+		return v
+	}
+	for r.Len() > 0 {
+		if r.Len() < 12 {
+			return nil, errors.New("truncated btf type")
+		}
+		nameOff, info, sizeOrType := read(), read(), read()
+		t := &BTFType{
+			Name:     name(nameOff),
+			Kind:     int(info>>24) & 0x1f,
+			KindFlag: info>>31 == 1,
+			Vlen:     int(info & 0xffff),
+		}
+		switch t.Kind {
+		case BTF_KIND_INT, BTF_KIND_ENUM, BTF_KIND_STRUCT, BTF_KIND_UNION,
+			BTF_KIND_DATASEC, BTF_KIND_FLOAT, BTF_KIND_ENUM64:
+			t.Size = sizeOrType
+		default:
+			t.Type = sizeOrType
+		}
+
+		switch t.Kind {
+		case BTF_KIND_INT:
+			v := read()
+			t.IntEncoding = uint8(v >> 24 & 0x0f)
+			t.IntOffset = uint8(v >> 16)
+			t.IntBits = uint8(v)
+		case BTF_KIND_ARRAY:
+			t.ArrayType = read()
+			read() /* index type */
+			t.ArrayNelems = read()
+		case BTF_KIND_STRUCT, BTF_KIND_UNION:
+			for i := 0; i < t.Vlen; i++ {
+				m := BTFMember{Name: name(read()), Type: read()}
+				offset := read()
+				if t.KindFlag {
+					m.BitSize = offset >> 24
+					m.BitOffset = offset & 0xffffff
+				} else {
+					m.BitOffset = offset
+				}
+				t.Members = append(t.Members, m)
+			}
+		case BTF_KIND_ENUM:
+			for i := 0; i < t.Vlen; i++ {
+				n := name(read())
+				t.EnumValues = append(t.EnumValues, BTFEnumValue{n, int64(int32(read()))})
+			}
+		case BTF_KIND_ENUM64:
+			for i := 0; i < t.Vlen; i++ {
+				n := name(read())
+				lo, hi := read(), read()
+				t.EnumValues = append(t.EnumValues, BTFEnumValue{n, int64(uint64(hi)<<32 | uint64(lo))})
+			}
+		case BTF_KIND_FUNC_PROTO:
+			for i := 0; i < t.Vlen; i++ {
+				t.Params = append(t.Params, BTFParam{Name: name(read()), Type: read()})
+			}
+		case BTF_KIND_VAR, BTF_KIND_DECL_TAG:
+			read()
+		case BTF_KIND_DATASEC:
+			for i := 0; i < t.Vlen*3; i++ {
+				read()
+			}
+		case BTF_KIND_PTR, BTF_KIND_FWD, BTF_KIND_TYPEDEF, BTF_KIND_VOLATILE, BTF_KIND_CONST,
+			BTF_KIND_RESTRICT, BTF_KIND_FUNC, BTF_KIND_FLOAT, BTF_KIND_TYPE_TAG:
+		default:
+			return nil, fmt.Errorf("unknown btf kind %d", t.Kind)
+		}
+
+		id := uint32(len(b.types))
+		b.types = append(b.types, t)
+		if t.Name != "" {
+			b.byName[t.Name] = append(b.byName[t.Name], id)
+		}
+	}
+	return b, nil
+}
+
+func (b *BTF) TypeByID(id uint32) *BTFType {
+	if int(id) >= len(b.types) {
+		return nil
+	}
+	return b.types[id]
+}
+
+// FindByName returns the id of the first type of the given kind named name.
+func (b *BTF) FindByName(name string, kind int) (uint32, error) {
+	for _, id := range b.byName[name] {
+		if b.types[id].Kind == kind {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("btf type %s of kind %d is not found", name, kind)
+}
+
+// EnumValue looks up an enumerator by name in all enums, including anonymous
+// ones, which are how kernels define constants like ___GFP_DMA_BIT.
+func (b *BTF) EnumValue(name string) (int64, error) {
+	for _, t := range b.types {
+		if t.Kind != BTF_KIND_ENUM && t.Kind != BTF_KIND_ENUM64 {
+			continue
+		}
+		for _, v := range t.EnumValues {
+			if v.Name == name {
+				return v.Value, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("btf enumerator %s is not found", name)
+}
+
+// SkipModsAndTypedefs follows typedefs and type modifiers (const, volatile,
+// restrict and type tags) to the underlying type.
+func (b *BTF) SkipModsAndTypedefs(id uint32) uint32 {
+	for i := 0; i < btfMaxResolveDepth; i++ {
+		t := b.TypeByID(id)
+		if t == nil {
+			return id
+		}
+		switch t.Kind {
+		case BTF_KIND_TYPEDEF, BTF_KIND_VOLATILE, BTF_KIND_CONST, BTF_KIND_RESTRICT, BTF_KIND_TYPE_TAG:
+			id = t.Type
+		default:
+			return id
+		}
+	}
+	return id
+}
+
+func (b *BTF) TypeSize(id uint32) (uint32, error) {
+	id = b.SkipModsAndTypedefs(id)
+	t := b.TypeByID(id)
+	if t == nil {
+		return 0, fmt.Errorf("invalid btf type id %d", id)
+	}
+	switch t.Kind {
+	case BTF_KIND_INT, BTF_KIND_ENUM, BTF_KIND_ENUM64, BTF_KIND_STRUCT, BTF_KIND_UNION, BTF_KIND_FLOAT:
+		return t.Size, nil
+	case BTF_KIND_PTR:
+		return 8, nil
+	case BTF_KIND_ARRAY:
+		size, err := b.TypeSize(t.ArrayType)
+		if err != nil {
+			return 0, err
+		}
+		return size * t.ArrayNelems, nil
+	}
+	return 0, fmt.Errorf("btf type %s of kind %d has no size", b.TypeName(id), t.Kind)
+}
+
+// TypeName returns the C declaration of a type, e.g. "struct sock *".
+func (b *BTF) TypeName(id uint32) string {
+	t := b.TypeByID(id)
+	if t == nil {
+		return "?"
+	}
+	switch t.Kind {
+	case BTF_KIND_UNKN:
+		return "void"
+	case BTF_KIND_PTR:
+		name := b.TypeName(t.Type)
+		if strings.HasSuffix(name, "*") {
+			return name + "*"
+		}
+		return name + " *"
+	case BTF_KIND_CONST:
+		return "const " + b.TypeName(t.Type)
+	case BTF_KIND_VOLATILE:
+		return "volatile " + b.TypeName(t.Type)
+	case BTF_KIND_RESTRICT, BTF_KIND_TYPE_TAG:
+		return b.TypeName(t.Type)
+	case BTF_KIND_ARRAY:
+		return fmt.Sprintf("%s[%d]", b.TypeName(t.ArrayType), t.ArrayNelems)
+	case BTF_KIND_STRUCT, BTF_KIND_UNION, BTF_KIND_ENUM, BTF_KIND_ENUM64, BTF_KIND_FWD:
+		prefix := "struct"
+		switch {
+		case t.Kind == BTF_KIND_UNION || (t.Kind == BTF_KIND_FWD && t.KindFlag):
+			prefix = "union"
+		case t.Kind == BTF_KIND_ENUM || t.Kind == BTF_KIND_ENUM64:
+			prefix = "enum"
+		}
+		if t.Name == "" {
+			return prefix + " {...}"
+		}
+		return prefix + " " + t.Name
+	case BTF_KIND_FUNC_PROTO:
+		return "func"
+	}
+	return t.Name
+}
+
+// FindMember looks up a member of a struct or union by name, including the
+// members of its anonymous struct and union members. It returns the type of
+// the member and its bit offset from the start of the outer type.
+func (b *BTF) FindMember(id uint32, name string) (*BTFMember, error) {
+	id = b.SkipModsAndTypedefs(id)
+	t := b.TypeByID(id)
+	if t == nil || (t.Kind != BTF_KIND_STRUCT && t.Kind != BTF_KIND_UNION) {
+		return nil, fmt.Errorf("%s is not a struct or union", b.TypeName(id))
+	}
+	for _, m := range t.Members {
+		if m.Name == name {
+			m := m
+			return &m, nil
+		}
+	}
+	for _, m := range t.Members {
+		if m.Name != "" {
+			continue
+		}
+		if nested, err := b.FindMember(m.Type, name); err == nil {
+			nested.BitOffset += m.BitOffset
+			return nested, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no member %s", b.TypeName(id), name)
+}
+
+// FormatValue formats data as a value of the given type, e.g.
+// "(struct sock){ .sk_state = 1, ... }". Values whose data is cut short are
+// formatted as far as possible and marked with "...".
+func (b *BTF) FormatValue(id uint32, data []byte) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "(%s)", b.TypeName(id))
+	b.formatData(&sb, id, data, 0)
+	return sb.String()
+}
+
+func isZero(data []byte) bool {
+	for _, c := range data {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readBits reads an unsigned little-endian integer of bitSize bits at
+// bitOffset of data.
+func readBits(data []byte, bitOffset, bitSize uint32) (uint64, bool) {
+	if bitSize == 0 || bitSize > 64 {
+		return 0, false
+	}
+	start := bitOffset / 8
+	end := (bitOffset + bitSize + 7) / 8
+	if uint64(end) > uint64(len(data)) {
+		return 0, false
+	}
+	var buf [16]byte
+	copy(buf[:], data[start:end])
+	lo := binary.LittleEndian.Uint64(buf[:8])
+	hi := binary.LittleEndian.Uint64(buf[8:])
+	shift := bitOffset % 8
+	v := lo >> shift
+	if shift > 0 {
+		v |= hi << (64 - shift)
+	}
+	if bitSize < 64 {
+		v &= 1<<bitSize - 1
+	}
+	return v, true
+}
+
+func (b *BTF) formatInt(sb *strings.Builder, t *BTFType, v uint64, bits uint32) {
+	switch {
+	case t.IntEncoding&BTF_INT_BOOL != 0:
+		sb.WriteString(strconv.FormatBool(v != 0))
+	case t.IntEncoding&BTF_INT_SIGNED != 0:
+		shift := 64 - bits
+		sb.WriteString(strconv.FormatInt(int64(v<<shift)>>shift, 10))
+	default:
+		sb.WriteString(strconv.FormatUint(v, 10))
+	}
+}
+
+func (b *BTF) formatBitfield(sb *strings.Builder, id uint32, data []byte, bitOffset, bitSize uint32) {
+	id = b.SkipModsAndTypedefs(id)
+	t := b.TypeByID(id)
+	v, ok := readBits(data, bitOffset, bitSize)
+	if !ok {
+		sb.WriteString("...")
+		return
+	}
+	if t != nil && t.Kind == BTF_KIND_INT {
+		b.formatInt(sb, t, v, bitSize)
+		return
+	}
+	sb.WriteString(strconv.FormatUint(v, 10))
+}
+
+func (b *BTF) formatData(sb *strings.Builder, id uint32, data []byte, level int) {
+	id = b.SkipModsAndTypedefs(id)
+	t := b.TypeByID(id)
+	if t == nil {
+		sb.WriteString("?")
+		return
+	}
+	size, err := b.TypeSize(id)
+	if err != nil {
+		sb.WriteString("?")
+		return
+	}
+
+	switch t.Kind {
+	case BTF_KIND_INT:
+		if (t.IntBits > 0 && uint32(t.IntBits) != size*8) || t.IntOffset > 0 {
+			b.formatBitfield(sb, id, data, uint32(t.IntOffset), uint32(t.IntBits))
+			return
+		}
+		if size > 8 {
+			/* __int128 */
+			if uint32(len(data)) < size {
+				sb.WriteString("...")
+				return
+			}
+			sb.WriteString("0x")
+			for i := int(size) - 1; i >= 0; i-- {
+				fmt.Fprintf(sb, "%02x", data[i])
+			}
+			return
+		}
+		v, ok := readBits(data, 0, size*8)
+		if !ok {
+			sb.WriteString("...")
+			return
+		}
+		b.formatInt(sb, t, v, size*8)
+	case BTF_KIND_PTR:
+		v, ok := readBits(data, 0, 64)
+		if !ok {
+			sb.WriteString("...")
+			return
+		}
+		fmt.Fprintf(sb, "0x%x", v)
+	case BTF_KIND_ENUM, BTF_KIND_ENUM64:
+		v, ok := readBits(data, 0, size*8)
+		if !ok {
+			sb.WriteString("...")
+			return
+		}
+		mask := ^uint64(0)
+		if size < 8 {
+			mask = 1<<(size*8) - 1
+		}
+		for _, e := range t.EnumValues {
+			if uint64(e.Value)&mask == v {
+				sb.WriteString(e.Name)
+				return
+			}
+		}
+		sb.WriteString(strconv.FormatUint(v, 10))
+	case BTF_KIND_FLOAT:
+		v, ok := readBits(data, 0, size*8)
+		if !ok {
+			sb.WriteString("...")
+			return
+		}
+		switch size {
+		case 4:
+			sb.WriteString(strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32))
+		case 8:
+			sb.WriteString(strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64))
+		default:
+			sb.WriteString("?")
+		}
+	case BTF_KIND_ARRAY:
+		b.formatArray(sb, t, data, level)
+	case BTF_KIND_STRUCT, BTF_KIND_UNION:
+		b.formatStruct(sb, t, data, level)
+	default:
+		sb.WriteString("?")
+	}
+}
+
+func (b *BTF) formatArray(sb *strings.Builder, t *BTFType, data []byte, level int) {
+	elemID := b.SkipModsAndTypedefs(t.ArrayType)
+	elem := b.TypeByID(elemID)
+	elemSize, err := b.TypeSize(elemID)
+	if err != nil || elemSize == 0 {
+		sb.WriteString("?")
+		return
+	}
+	if elem.Kind == BTF_KIND_INT && elemSize == 1 && (elem.IntEncoding&BTF_INT_CHAR != 0 || elem.Name == "char") {
+		end := int(t.ArrayNelems)
+		if end > len(data) {
+			end = len(data)
+		}
+		s := data[:end]
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		sb.WriteString(strconv.Quote(string(s)))
+		return
+	}
+
+	sb.WriteString("[")
+	for i := uint32(0); i < t.ArrayNelems; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		start := uint64(i) * uint64(elemSize)
+		if start+uint64(elemSize) > uint64(len(data)) {
+			sb.WriteString("...")
+			break
+		}
+		b.formatData(sb, elemID, data[start:start+uint64(elemSize)], level)
+	}
+	sb.WriteString("]")
+}
+
+// formatStruct formats the non-zero members of a struct or union, one member
+// per line, in the style of libbpf's btf_dump__dump_type_data.
+func (b *BTF) formatStruct(sb *strings.Builder, t *BTFType, data []byte, level int) {
+	indent := strings.Repeat(" ", level+1)
+	sb.WriteString("{")
+	var printed bool
+	for _, m := range t.Members {
+		if m.BitOffset/8 >= uint32(len(data)) {
+			sb.WriteString("\n" + indent + "...")
+			printed = true
+			break
+		}
+		if m.BitSize > 0 {
+			v, ok := readBits(data, m.BitOffset, m.BitSize)
+			if ok && v == 0 {
+				continue
+			}
+			fmt.Fprintf(sb, "\n%s.%s = ", indent, m.Name)
+			b.formatBitfield(sb, m.Type, data, m.BitOffset, m.BitSize)
+			sb.WriteString(",")
+			printed = true
+			continue
+		}
+
+		size, err := b.TypeSize(m.Type)
+		if err != nil {
+			continue
+		}
+		start := uint64(m.BitOffset / 8)
+		end := start + uint64(size)
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		memberData := data[start:end]
+		if isZero(memberData) && end-start == uint64(size) {
+			continue
+		}
+		sb.WriteString("\n" + indent)
+		if m.Name != "" {
+			fmt.Fprintf(sb, ".%s = ", m.Name)
+		}
+		memberType := b.TypeByID(b.SkipModsAndTypedefs(m.Type))
+		if memberType != nil && (memberType.Kind == BTF_KIND_STRUCT || memberType.Kind == BTF_KIND_UNION) {
+			fmt.Fprintf(sb, "(%s)", b.TypeName(m.Type))
+		}
+		b.formatData(sb, m.Type, memberData, level+1)
+		sb.WriteString(",")
+		printed = true
+	}
+	if printed {
+		sb.WriteString("\n" + strings.Repeat(" ", level))
+	}
+	sb.WriteString("}")
+}
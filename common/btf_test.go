@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type testBTFBuilder struct {
+	types bytes.Buffer
+	strs  bytes.Buffer
+}
+
+func (b *testBTFBuilder) str(s string) uint32 {
+	if b.strs.Len() == 0 {
+		b.strs.WriteByte(0)
+	}
+	if s == "" {
+		return 0
+	}
+	off := uint32(b.strs.Len())
+	b.strs.WriteString(s)
+	b.strs.WriteByte(0)
+	return off
+}
+
+func (b *testBTFBuilder) add(name string, kind int, kindFlag bool, vlen int, sizeOrType uint32, extra ...uint32) {
+	info := uint32(kind)<<24 | uint32(vlen)
+	if kindFlag {
+		info |= 1 << 31
+	}
+	for _, v := range append([]uint32{b.str(name), info, sizeOrType}, extra...) {
+		_ = binary.Write(&b.types, binary.LittleEndian, v)
+	}
+}
+
+func (b *testBTFBuilder) bytes() []byte {
+	b.str("")
+	hdr := btfHeader{
+		Magic:   BTF_MAGIC,
+		Version: 1,
+		HdrLen:  24,
+		TypeLen: uint32(b.types.Len()),
+		StrOff:  uint32(b.types.Len()),
+		StrLen:  uint32(b.strs.Len()),
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, hdr)
+	buf.Write(b.types.Bytes())
+	buf.Write(b.strs.Bytes())
+	return buf.Bytes()
+}
+
+func newTestBTF(t *testing.T) *BTF {
+	var b testBTFBuilder
+	b.add("int", BTF_KIND_INT, false, 0, 4, BTF_INT_SIGNED<<24|32)                                    // 1
+	b.add("unsigned char", BTF_KIND_INT, false, 0, 1, 8)                                              // 2
+	b.add("char", BTF_KIND_INT, false, 0, 1, BTF_INT_CHAR<<24|8)                                      // 3
+	b.add("", BTF_KIND_ARRAY, false, 0, 0, 3, 1, 4)                                                   // 4: char[4]
+	b.add("state", BTF_KIND_ENUM, false, 2, 4, b.str("TCP_ESTABLISHED"), 1, b.str("TCP_SYN_SENT"), 2) // 5
+	b.add("foo", BTF_KIND_STRUCT, true, 4, 16,
+		b.str("a"), 1, 0,
+		b.str("flag"), 2, 3<<24|32,
+		b.str("name"), 4, 64,
+		b.str("st"), 5, 96) // 6
+	b.add("", BTF_KIND_PTR, false, 0, 6)                       // 7
+	b.add("foo_t", BTF_KIND_TYPEDEF, false, 0, 6)              // 8
+	b.add("", BTF_KIND_STRUCT, false, 1, 16, 0, 6, 0)          // 9: struct { struct foo; }
+	b.add("", BTF_KIND_ENUM, false, 1, 4, b.str("FOO_BIT"), 3) // 10: enum { FOO_BIT = 3 }
+	btf, err := ParseBTF(b.bytes())
+	if err != nil {
+		t.Fatalf("ParseBTF() error = %v", err)
+	}
+	return btf
+}
+
+func TestBTF_TypeName(t *testing.T) {
+	btf := newTestBTF(t)
+	tests := []struct {
+		id   uint32
+		want string
+	}{
+		{0, "void"},
+		{1, "int"},
+		{4, "char[4]"},
+		{5, "enum state"},
+		{6, "struct foo"},
+		{7, "struct foo *"},
+		{8, "foo_t"},
+		{9, "struct {...}"},
+	}
+	for _, tt := range tests {
+		if got := btf.TypeName(tt.id); got != tt.want {
+			t.Errorf("TypeName(%d) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestBTF_FindMember(t *testing.T) {
+	btf := newTestBTF(t)
+	m, err := btf.FindMember(8, "st")
+	if err != nil {
+		t.Fatalf("FindMember() error = %v", err)
+	}
+	if m.Type != 5 || m.BitOffset != 96 {
+		t.Errorf("FindMember() = %+v, want type 5 at bit 96", m)
+	}
+	/* members of anonymous members are found too */
+	if m, err := btf.FindMember(9, "name"); err != nil || m.BitOffset != 64 {
+		t.Errorf("FindMember() = %+v, %v, want bit 64", m, err)
+	}
+	if _, err := btf.FindMember(6, "nope"); err == nil {
+		t.Errorf("FindMember() expected an error for a missing member")
+	}
+	if id, err := btf.FindByName("foo", BTF_KIND_STRUCT); err != nil || id != 6 {
+		t.Errorf("FindByName() = %d, %v, want 6", id, err)
+	}
+}
+
+func TestBTF_EnumValue(t *testing.T) {
+	btf := newTestBTF(t)
+	if v, err := btf.EnumValue("TCP_SYN_SENT"); err != nil || v != 2 {
+		t.Errorf("EnumValue() = %d, %v, want 2", v, err)
+	}
+	/* enumerators of anonymous enums are found too */
+	if v, err := btf.EnumValue("FOO_BIT"); err != nil || v != 3 {
+		t.Errorf("EnumValue() = %d, %v, want 3", v, err)
+	}
+	if _, err := btf.EnumValue("NOPE"); err == nil {
+		t.Errorf("EnumValue() expected an error for a missing enumerator")
+	}
+}
+
+func TestBTF_FormatValue(t *testing.T) {
+	btf := newTestBTF(t)
+	data := []byte{
+		0xfe, 0xff, 0xff, 0xff, // a = -2
+		0x05, 0, 0, 0, // flag = 5 (3 bits)
+		'a', 'b', 0, 0, // name = "ab"
+		1, 0, 0, 0, // st = TCP_ESTABLISHED
+	}
+	want := "(struct foo){\n .a = -2,\n .flag = 5,\n .name = \"ab\",\n .st = TCP_ESTABLISHED,\n}"
+	if got := btf.FormatValue(6, data); got != want {
+		t.Errorf("FormatValue() = %q, want %q", got, want)
+	}
+	if got := btf.FormatValue(6, make([]byte, 16)); got != "(struct foo){}" {
+		t.Errorf("FormatValue() = %q, want empty struct", got)
+	}
+	if got := btf.FormatValue(6, data[:6]); got != "(struct foo){\n .a = -2,\n .flag = 5,\n ...\n}" {
+		t.Errorf("FormatValue() = %q, want a truncated struct", got)
+	}
+	if got := btf.FormatValue(7, []byte{0x10, 0x20, 0, 0, 0, 0, 0, 0}); got != "(struct foo *)0x2010" {
+		t.Errorf("FormatValue() = %q, want a pointer", got)
+	}
+}
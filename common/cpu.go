@@ -0,0 +1,36 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NumPossibleCPUs is bpf.NumPossibleCPUs for the helpers here, as common is
+// built against libbpfgo v0.4.4 which doesn't have it.
+func NumPossibleCPUs() (int, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, err
+	}
+	return parseCPUList(strings.TrimSpace(string(data)))
+}
+
+// parseCPUList returns the number of cpus of a cpu list like "0-3,5",
+// which is the highest cpu id plus one.
+func parseCPUList(s string) (int, error) {
+	var maxCPU int
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		last := bounds[len(bounds)-1]
+		n, err := strconv.Atoi(last)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cpu list %s: %w", s, err)
+		}
+		if n+1 > maxCPU {
+			maxCPU = n + 1
+		}
+	}
+	return maxCPU, nil
+}
@@ -0,0 +1,29 @@
+package common
+
+import "testing"
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    int
+		wantErr bool
+	}{
+		{name: "single", s: "0", want: 1},
+		{name: "range", s: "0-3", want: 4},
+		{name: "mixed", s: "0-3,5,7-8", want: 9},
+		{name: "invalid", s: "0-x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCPUList(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCPUList() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseCPUList() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package common
+
+import "fmt"
+
+const (
+	HI_SOFTIRQ = iota
+	TIMER_SOFTIRQ
+	NET_TX_SOFTIRQ
+	NET_RX_SOFTIRQ
+	BLOCK_SOFTIRQ
+	IRQ_POLL_SOFTIRQ
+	TASKLET_SOFTIRQ
+	SCHED_SOFTIRQ
+	HRTIMER_SOFTIRQ
+	RCU_SOFTIRQ
+	NR_SOFTIRQS
+)
+
+var softirqNames = [NR_SOFTIRQS]string{
+	HI_SOFTIRQ:       "hi",
+	TIMER_SOFTIRQ:    "timer",
+	NET_TX_SOFTIRQ:   "net_tx",
+	NET_RX_SOFTIRQ:   "net_rx",
+	BLOCK_SOFTIRQ:    "block",
+	IRQ_POLL_SOFTIRQ: "irq_poll",
+	TASKLET_SOFTIRQ:  "tasklet",
+	SCHED_SOFTIRQ:    "sched",
+	HRTIMER_SOFTIRQ:  "hrtimer",
+	RCU_SOFTIRQ:      "rcu",
+}
+
+func SoftirqName(vec int) string {
+	if vec < 0 || vec >= NR_SOFTIRQS {
+		return fmt.Sprintf("[unknown: %d]", vec)
+	}
+	return softirqNames[vec]
+}
@@ -38,3 +38,92 @@ func clearHash(bpfMap *bpf.BPFMap) error {
 	}
 	return nil
 }
+
+func DumpArray(bpfMap *bpf.BPFMap) ([][]byte, error) {
+	var ret [][]byte
+	for i := uint32(0); i < bpfMap.GetMaxEntries(); i++ {
+		key := i
+		value, err := bpfMap.GetValue(unsafe.Pointer(&key))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value)
+	}
+	return ret, nil
+}
+
+// DumpThenClearArray returns every value of an array map and zeroes them.
+// It also works on the .bss map of an object, which libbpf backs with a
+// single-entry array holding all zero-initialized globals.
+func DumpThenClearArray(bpfMap *bpf.BPFMap) ([][]byte, error) {
+	ret, err := DumpArray(bpfMap)
+	if err != nil {
+		return nil, err
+	}
+	return ret, clearArray(bpfMap)
+}
+
+func clearArray(bpfMap *bpf.BPFMap) error {
+	zero := make([]byte, bpfMap.ValueSize())
+	for i := uint32(0); i < bpfMap.GetMaxEntries(); i++ {
+		key := i
+		if err := bpfMap.Update(unsafe.Pointer(&key), unsafe.Pointer(&zero[0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetPerCPUValue(bpfMap *bpf.BPFMap, key unsafe.Pointer) ([][]byte, error) {
+	cpus, err := NumPossibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+	/* each per-cpu value is rounded up to 8 bytes by the kernel */
+	valueSize := (bpfMap.ValueSize() + 7) / 8 * 8
+	value := make([]byte, valueSize*cpus)
+	if err := bpfMap.GetValueReadInto(key, &value); err != nil {
+		return nil, err
+	}
+	ret := make([][]byte, cpus)
+	for i := 0; i < cpus; i++ {
+		ret[i] = value[i*valueSize : i*valueSize+bpfMap.ValueSize()]
+	}
+	return ret, nil
+}
+
+func DumpPerCPUArray(bpfMap *bpf.BPFMap) ([][][]byte, error) {
+	var ret [][][]byte
+	for i := uint32(0); i < bpfMap.GetMaxEntries(); i++ {
+		key := i
+		value, err := GetPerCPUValue(bpfMap, unsafe.Pointer(&key))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value)
+	}
+	return ret, nil
+}
+
+func DumpThenClearPerCPUArray(bpfMap *bpf.BPFMap) ([][][]byte, error) {
+	ret, err := DumpPerCPUArray(bpfMap)
+	if err != nil {
+		return nil, err
+	}
+	return ret, clearPerCPUArray(bpfMap)
+}
+
+func clearPerCPUArray(bpfMap *bpf.BPFMap) error {
+	cpus, err := NumPossibleCPUs()
+	if err != nil {
+		return err
+	}
+	zero := make([]byte, (bpfMap.ValueSize()+7)/8*8*cpus)
+	for i := uint32(0); i < bpfMap.GetMaxEntries(); i++ {
+		key := i
+		if err := bpfMap.Update(unsafe.Pointer(&key), unsafe.Pointer(&zero[0])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,6 +16,44 @@ const (
 	IPPROTO_UDP = 17
 )
 
+const (
+	TCP_ESTABLISHED = iota + 1
+	TCP_SYN_SENT
+	TCP_SYN_RECV
+	TCP_FIN_WAIT1
+	TCP_FIN_WAIT2
+	TCP_TIME_WAIT
+	TCP_CLOSE
+	TCP_CLOSE_WAIT
+	TCP_LAST_ACK
+	TCP_LISTEN
+	TCP_CLOSING
+	TCP_NEW_SYN_RECV
+	TCP_MAX_STATES
+)
+
+var tcpStateNames = [TCP_MAX_STATES]string{
+	TCP_ESTABLISHED:  "ESTABLISHED",
+	TCP_SYN_SENT:     "SYN_SENT",
+	TCP_SYN_RECV:     "SYN_RECV",
+	TCP_FIN_WAIT1:    "FIN_WAIT1",
+	TCP_FIN_WAIT2:    "FIN_WAIT2",
+	TCP_TIME_WAIT:    "TIME_WAIT",
+	TCP_CLOSE:        "CLOSE",
+	TCP_CLOSE_WAIT:   "CLOSE_WAIT",
+	TCP_LAST_ACK:     "LAST_ACK",
+	TCP_LISTEN:       "LISTEN",
+	TCP_CLOSING:      "CLOSING",
+	TCP_NEW_SYN_RECV: "NEW_SYN_RECV",
+}
+
+func TCPStateName(state int) string {
+	if state <= 0 || state >= TCP_MAX_STATES {
+		return "UNKNOWN"
+	}
+	return tcpStateNames[state]
+}
+
 type Uint128 [16]byte
 
 func Htons(i uint16) uint16 {
@@ -80,3 +80,37 @@ func TestHtons(t *testing.T) {
 		})
 	}
 }
+
+func TestTCPStateName(t *testing.T) {
+	type args struct {
+		state int
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "established",
+			args: args{TCP_ESTABLISHED},
+			want: "ESTABLISHED",
+		},
+		{
+			name: "new syn recv",
+			args: args{TCP_NEW_SYN_RECV},
+			want: "NEW_SYN_RECV",
+		},
+		{
+			name: "unknown",
+			args: args{TCP_MAX_STATES},
+			want: "UNKNOWN",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TCPStateName(tt.args.state); got != tt.want {
+				t.Errorf("TCPStateName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	PERF_TYPE_HARDWARE = 0
+	PERF_TYPE_SOFTWARE = 1
+
+	PERF_COUNT_HW_CPU_CYCLES = 0
+	PERF_COUNT_SW_CPU_CLOCK  = 0
+)
+
+const (
+	perfBitFreq         = 1 << 10
+	perfFlagFdCloexec   = 1 << 3
+	perfAttrSizeVersion = 64
+)
+
+// perfEventAttr is the first version of struct perf_event_attr, which is all
+// that sampling events for bpf programs need.
+type perfEventAttr struct {
+	Type        uint32
+	Size        uint32
+	Config      uint64
+	SampleFreq  uint64
+	SampleType  uint64
+	ReadFormat  uint64
+	Flags       uint64
+	WakeupEvent uint32
+	BpType      uint32
+	Config1     uint64
+}
+
+func perfEventOpen(attr *perfEventAttr, pid, cpu, groupFd int, flags uint) (int, error) {
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(attr)),
+		uintptr(pid), uintptr(cpu), uintptr(groupFd), uintptr(flags), 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// OpenPerfEvent opens a perf event of the given type and config on cpu,
+// sampling freq times per second, and returns the fd of the event.
+func OpenPerfEvent(typ uint32, config uint64, freq uint64, cpu int) (int, error) {
+	attr := perfEventAttr{
+		Type:       typ,
+		Size:       perfAttrSizeVersion,
+		Config:     config,
+		SampleFreq: freq,
+		Flags:      perfBitFreq,
+	}
+	return perfEventOpen(&attr, -1, cpu, -1, perfFlagFdCloexec)
+}
+
+// OpenPerfEvents opens a perf event of the given type and config on every
+// online cpu, sampling freq times per second, and returns the fds of the
+// events. Offline cpus are skipped.
+func OpenPerfEvents(typ uint32, config uint64, freq uint64) ([]int, error) {
+	cpus, err := NumPossibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for cpu := 0; cpu < cpus; cpu++ {
+		fd, err := OpenPerfEvent(typ, config, freq, cpu)
+		if err != nil {
+			/* ignore CPU that is offline */
+			if errors.Is(err, syscall.ENODEV) {
+				continue
+			}
+			ClosePerfEvents(fds)
+			return nil, fmt.Errorf("failed to init perf sampling on cpu %d: %w", cpu, err)
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
+}
+
+func ClosePerfEvents(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
@@ -0,0 +1,12 @@
+package common
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestPerfEventAttrSize(t *testing.T) {
+	if got := unsafe.Sizeof(perfEventAttr{}); got != perfAttrSizeVersion {
+		t.Errorf("sizeof(perfEventAttr) = %d, want %d", got, perfAttrSizeVersion)
+	}
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"time"
+)
+
+/* field numbers of the messages in pprof's profile.proto */
+const (
+	pprofProfileSampleType    = 1
+	pprofProfileSample        = 2
+	pprofProfileLocation      = 4
+	pprofProfileFunction      = 5
+	pprofProfileStringTable   = 6
+	pprofProfileTimeNanos     = 9
+	pprofProfileDurationNanos = 10
+	pprofProfilePeriodType    = 11
+	pprofProfilePeriod        = 12
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationId = 1
+	pprofSampleValue      = 2
+	pprofSampleLabel      = 3
+
+	pprofLabelKey = 1
+	pprofLabelStr = 2
+	pprofLabelNum = 3
+
+	pprofLocationId   = 1
+	pprofLocationLine = 4
+
+	pprofLineFunctionId = 1
+
+	pprofFunctionId   = 1
+	pprofFunctionName = 2
+)
+
+type pprofSample struct {
+	locations []uint64
+	value     int64
+	labels    map[string]string
+	numLabels map[string]int64
+}
+
+// Pprof builds a profile in the pprof format, where each sample is a stack of
+// function names with a single value.
+type Pprof struct {
+	sampleType string
+	sampleUnit string
+	periodType string
+	periodUnit string
+	period     int64
+	start      time.Time
+
+	strings   []string
+	stringIds map[string]int64
+	/* locations and functions share ids, as there is one per function name */
+	functions map[string]uint64
+	names     []string
+	samples   []pprofSample
+}
+
+// NewPprof returns a profile whose samples are of sampleType in sampleUnit,
+// e.g. "samples" and "count", taken every period periodUnit of periodType,
+// e.g. every 10000000 nanoseconds of cpu.
+func NewPprof(sampleType, sampleUnit, periodType, periodUnit string, period int64) *Pprof {
+	return &Pprof{
+		sampleType: sampleType,
+		sampleUnit: sampleUnit,
+		periodType: periodType,
+		periodUnit: periodUnit,
+		period:     period,
+		start:      time.Now(),
+		stringIds:  map[string]int64{"": 0},
+		strings:    []string{""},
+		functions:  map[string]uint64{},
+	}
+}
+
+func (p *Pprof) stringId(s string) int64 {
+	if id, ok := p.stringIds[s]; ok {
+		return id
+	}
+	id := int64(len(p.strings))
+	p.strings = append(p.strings, s)
+	p.stringIds[s] = id
+	return id
+}
+
+func (p *Pprof) functionId(name string) uint64 {
+	if id, ok := p.functions[name]; ok {
+		return id
+	}
+	p.names = append(p.names, name)
+	id := uint64(len(p.names))
+	p.functions[name] = id
+	return id
+}
+
+// AddSample adds a sample of stack, which is ordered from the leaf function
+// to the root function, with string and numeric labels like "comm" or "pid".
+func (p *Pprof) AddSample(stack []string, value int64, labels map[string]string, numLabels map[string]int64) {
+	s := pprofSample{value: value, labels: labels, numLabels: numLabels}
+	for _, name := range stack {
+		s.locations = append(s.locations, p.functionId(name))
+	}
+	p.samples = append(p.samples, s)
+}
+
+// Write writes the gzipped profile to w.
+func (p *Pprof) Write(w io.Writer) error {
+	var b protoBuffer
+	valueType := func(typ, unit string) []byte {
+		var vt protoBuffer
+		vt.int64(pprofValueTypeType, p.stringId(typ))
+		vt.int64(pprofValueTypeUnit, p.stringId(unit))
+		return vt.data
+	}
+	b.bytes(pprofProfileSampleType, valueType(p.sampleType, p.sampleUnit))
+
+	for _, s := range p.samples {
+		var sb protoBuffer
+		sb.packedUint64(pprofSampleLocationId, s.locations)
+		sb.packedUint64(pprofSampleValue, []uint64{uint64(s.value)})
+		for _, k := range sortedKeys(s.labels) {
+			var lb protoBuffer
+			lb.int64(pprofLabelKey, p.stringId(k))
+			lb.int64(pprofLabelStr, p.stringId(s.labels[k]))
+			sb.bytes(pprofSampleLabel, lb.data)
+		}
+		for _, k := range sortedKeys(s.numLabels) {
+			var lb protoBuffer
+			lb.int64(pprofLabelKey, p.stringId(k))
+			lb.int64(pprofLabelNum, s.numLabels[k])
+			sb.bytes(pprofSampleLabel, lb.data)
+		}
+		b.bytes(pprofProfileSample, sb.data)
+	}
+
+	for i, name := range p.names {
+		id := uint64(i + 1)
+		var line protoBuffer
+		line.uint64(pprofLineFunctionId, id)
+		var loc protoBuffer
+		loc.uint64(pprofLocationId, id)
+		loc.bytes(pprofLocationLine, line.data)
+		b.bytes(pprofProfileLocation, loc.data)
+
+		var fn protoBuffer
+		fn.uint64(pprofFunctionId, id)
+		fn.int64(pprofFunctionName, p.stringId(name))
+		b.bytes(pprofProfileFunction, fn.data)
+	}
+
+	b.int64(pprofProfileTimeNanos, p.start.UnixNano())
+	b.int64(pprofProfileDurationNanos, int64(time.Since(p.start)))
+	b.bytes(pprofProfilePeriodType, valueType(p.periodType, p.periodUnit))
+	b.int64(pprofProfilePeriod, p.period)
+	/* the string table is written last, as the fields above add strings */
+	for _, s := range p.strings {
+		b.bytes(pprofProfileStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(b.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// protoBuffer is a minimal protocol buffers encoder.
+type protoBuffer struct {
+	data []byte
+}
+
+const (
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+	b.data = append(b.data, byte(v))
+}
+
+func (b *protoBuffer) key(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protoBuffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.key(field, protoWireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.key(field, protoWireBytes)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) packedUint64(field int, vs []uint64) {
+	var pb protoBuffer
+	for _, v := range vs {
+		pb.varint(v)
+	}
+	b.bytes(field, pb.data)
+}
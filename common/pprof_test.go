@@ -0,0 +1,96 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// decodeProto decodes the top level fields of a protocol buffers message,
+// returning varints as uint64 and length delimited fields as []byte.
+func decodeProto(t *testing.T, data []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	varint := func() uint64 {
+		var v uint64
+		for shift := 0; ; shift += 7 {
+			if len(data) == 0 {
+				t.Fatalf("truncated varint")
+			}
+			c := data[0]
+			data = data[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+	for len(data) > 0 {
+		key := varint()
+		field := int(key >> 3)
+		switch key & 7 {
+		case protoWireVarint:
+			fields[field] = append(fields[field], varint())
+		case protoWireBytes:
+			n := varint()
+			fields[field] = append(fields[field], data[:n])
+			data = data[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestPprof_Write(t *testing.T) {
+	p := NewPprof("samples", "count", "cpu", "nanoseconds", 10000000)
+	p.AddSample([]string{"leaf", "main"}, 3, map[string]string{"comm": "foo"}, map[string]int64{"pid": 1})
+	p.AddSample([]string{"other", "main"}, 5, nil, nil)
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := decodeProto(t, data)
+	var strs []string
+	for _, s := range fields[pprofProfileStringTable] {
+		strs = append(strs, string(s.([]byte)))
+	}
+	wantStrs := []string{"", "samples", "count", "comm", "foo", "pid", "leaf", "main", "other", "cpu", "nanoseconds"}
+	if !reflect.DeepEqual(strs, wantStrs) {
+		t.Errorf("string table = %q, want %q", strs, wantStrs)
+	}
+	if n := len(fields[pprofProfileSample]); n != 2 {
+		t.Errorf("got %d samples, want 2", n)
+	}
+	if n := len(fields[pprofProfileLocation]); n != 3 {
+		t.Errorf("got %d locations, want 3", n)
+	}
+	if n := len(fields[pprofProfileFunction]); n != 3 {
+		t.Errorf("got %d functions, want 3", n)
+	}
+	if got := fields[pprofProfilePeriod]; !reflect.DeepEqual(got, []interface{}{uint64(10000000)}) {
+		t.Errorf("period = %v, want 10000000", got)
+	}
+
+	sample := decodeProto(t, fields[pprofProfileSample][0].([]byte))
+	if got := sample[pprofSampleLocationId][0].([]byte); !bytes.Equal(got, []byte{1, 2}) {
+		t.Errorf("sample locations = %v, want [1 2]", got)
+	}
+	if got := sample[pprofSampleValue][0].([]byte); !bytes.Equal(got, []byte{3}) {
+		t.Errorf("sample values = %v, want [3]", got)
+	}
+	if n := len(sample[pprofSampleLabel]); n != 2 {
+		t.Errorf("got %d sample labels, want 2", n)
+	}
+}
@@ -0,0 +1,19 @@
+package common
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const CLOCK_MONOTONIC = 1
+
+// MonotonicTimeNs returns the time of the monotonic clock in nanoseconds,
+// which is the clock of bpf_ktime_get_ns().
+func MonotonicTimeNs() (uint64, error) {
+	var ts syscall.Timespec
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, CLOCK_MONOTONIC, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return uint64(ts.Sec)*1e9 + uint64(ts.Nsec), nil
+}
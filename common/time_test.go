@@ -0,0 +1,21 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMonotonicTimeNs(t *testing.T) {
+	t1, err := MonotonicTimeNs()
+	if err != nil {
+		t.Fatalf("MonotonicTimeNs() error = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	t2, err := MonotonicTimeNs()
+	if err != nil {
+		t.Fatalf("MonotonicTimeNs() error = %v", err)
+	}
+	if t2 < t1+uint64(10*time.Millisecond) {
+		t.Errorf("MonotonicTimeNs() = %d after %d, want at least 10ms later", t2, t1)
+	}
+}
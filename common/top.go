@@ -0,0 +1,50 @@
+package common
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type TopLoopOptions struct {
+	Interval uint64
+	Count    uint64
+	NoClear  bool
+}
+
+// RunTopLoop calls printFn every interval seconds until it has been called
+// count times or the process is interrupted, clearing the screen before each
+// call unless NoClear is set.
+func RunTopLoop(opts TopLoopOptions, printFn func()) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.Interval))
+	defer ticker.Stop()
+	var end bool
+	count := opts.Count
+
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+		case <-ticker.C:
+		}
+		if !opts.NoClear {
+			cmd := exec.Command("clear")
+			cmd.Stdout = os.Stdout
+			if err := cmd.Run(); err != nil {
+				return err
+			}
+		}
+
+		printFn()
+
+		count--
+		if end || count == 0 {
+			return nil
+		}
+	}
+}
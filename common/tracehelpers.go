@@ -7,9 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+
+	bpf "github.com/aquasecurity/libbpfgo"
 )
 
 func min(a, b int) int {
@@ -263,6 +269,77 @@ func (k *Ksyms) GetSymbol(name string) *Ksym {
 	return nil
 }
 
+var tracefsDirs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+func tracefsFile(name string) string {
+	for _, dir := range tracefsDirs {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+var (
+	kprobeFuncsOnce sync.Once
+	kprobeFuncs     map[string]bool
+)
+
+// loadKprobeFuncs reads the functions which can be kprobed only once, as
+// available_filter_functions is several megabytes.
+func loadKprobeFuncs() map[string]bool {
+	kprobeFuncsOnce.Do(func() {
+		kprobeFuncs = make(map[string]bool)
+		if p := tracefsFile("available_filter_functions"); p != "" {
+			fdata, err := os.ReadFile(p)
+			if err == nil {
+				s := bufio.NewScanner(bytes.NewReader(fdata))
+				for s.Scan() {
+					fields := strings.Fields(s.Text())
+					if len(fields) > 0 {
+						kprobeFuncs[fields[0]] = true
+					}
+				}
+				return
+			}
+		}
+
+		/* fall back to /proc/kallsyms when tracefs is not available */
+		ksyms, err := LoadKsyms()
+		if err != nil {
+			return
+		}
+		for _, sym := range ksyms.syms {
+			kprobeFuncs[sym.Name] = true
+		}
+	})
+	return kprobeFuncs
+}
+
+func KprobeExists(name string) bool {
+	return loadKprobeFuncs()[name]
+}
+
+func TracepointExists(category, event string) bool {
+	return tracefsFile(filepath.Join("events", category, event, "format")) != ""
+}
+
+func VmlinuxBTFExists() bool {
+	_, err := os.Stat("/sys/kernel/btf/vmlinux")
+	return err == nil
+}
+
+func FentryCanAttach(name string) bool {
+	if !VmlinuxBTFExists() {
+		return false
+	}
+	if ok, _ := bpf.BPFProgramTypeIsSupported(bpf.BPFProgTypeTracing); !ok {
+		return false
+	}
+	return KprobeExists(name)
+}
+
 type LoadRange struct {
 	start   uint64
 	end     uint64
@@ -278,28 +355,37 @@ const (
 )
 
 type Sym struct {
-	Name  string
-	start uint
-	size  uint
+	Name   string
+	start  uint
+	size   uint
+	Offset uint
 }
 
 type Syms struct {
-	dsos []Dso
+	dsos []*Dso
 }
 
 func (s *Syms) MapAddr(addr uint64) *Sym {
-	d, _ := s.findDso(addr)
+	sym, _, _ := s.MapAddrDso(addr)
+	return sym
+}
+
+// MapAddrDso is like MapAddr, and also returns the name of the dso which the
+// address belongs to and the offset of the address within that dso, so that
+// callers can still print something useful when no symbol is found.
+func (s *Syms) MapAddrDso(addr uint64) (*Sym, string, uint64) {
+	d, offset := s.findDso(addr)
 	if d == nil {
-		return nil
+		return nil, "", 0
 	}
-	return nil
+	return d.findSym(offset), d.name, offset
 }
 
 func (s *Syms) findDso(addr uint64) (*Dso, uint64) {
 	var offset uint64
 	for _, d := range s.dsos {
 		for _, r := range d.ranges {
-			if addr <= r.start || addr >= r.end {
+			if addr < r.start || addr >= r.end {
 				continue
 			}
 			if d._type == DYN || d._type == VDSO {
@@ -310,45 +396,45 @@ func (s *Syms) findDso(addr uint64) (*Dso, uint64) {
 			} else {
 				offset = addr
 			}
-			return &d, offset
+			return d, offset
 		}
 	}
 
 	return nil, 0
 }
 
-func (s *Syms) find_sym() {
-
-}
-
 type Dso struct {
 	name   string
 	ranges []LoadRange
-	// range_sz int
 	/* Dyn's first text section virtual addr at execution */
 	shAddr uint64
 	/* Dyn's first text section file offset */
 	shOffset uint64
 	_type    int
 	syms     []Sym
-
-	/*
-	 * libbpf's struct btf is actually a pretty efficient
-	 * "set of strings" data structure, so we create an
-	 * empty one and use it to store symbol names.
-	 */
-	// struct btf *btf;
+	loaded   bool
 }
 
 func (d *Dso) findSym(offset uint64) *Sym {
+	if !d.loaded {
+		d.loaded = true
+		if err := d.loadSymTable(); err != nil {
+			d.syms = nil
+		}
+	}
+
 	syms := d.syms
+	/* syms are sorted by start address in descending order */
 	i := sort.Search(len(syms), func(i int) bool {
-		// return syms[i].Addr <= addr
-		return true
+		return uint64(syms[i].start) <= offset
 	})
-
-	if i < len(syms) {
+	for ; i < len(syms); i++ {
 		v := syms[i]
+		if v.size > 0 && offset >= uint64(v.start+v.size) {
+			/* a smaller symbol may still contain the offset */
+			continue
+		}
+		v.Offset = uint(offset) - v.start
 		return &v
 	}
 	return nil
@@ -372,6 +458,37 @@ func (d *Dso) loadSymTableFromPerfMap() error {
 }
 
 func (d *Dso) loadSymTableFromElf(fd int) error {
+	f, err := elf.Open(d.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var elfSyms []elf.Symbol
+	if v, err := f.Symbols(); err == nil {
+		elfSyms = append(elfSyms, v...)
+	}
+	if v, err := f.DynamicSymbols(); err == nil {
+		elfSyms = append(elfSyms, v...)
+	}
+	for _, s := range elfSyms {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Value == 0 || s.Name == "" {
+			continue
+		}
+		d.syms = append(d.syms, Sym{
+			Name:  s.Name,
+			start: uint(s.Value),
+			size:  uint(s.Size),
+		})
+	}
+
+	syms := d.syms
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].start == syms[j].start {
+			return syms[i].Name >= syms[j].Name
+		}
+		return syms[i].start >= syms[j].start
+	})
 	return nil
 }
 
@@ -381,11 +498,10 @@ func (d *Dso) loadSymTableFromVdsoImage() error {
 
 type SymsCache struct {
 	data []SymsCacheData
-	// Nr   int
 }
 
 type SymsCacheData struct {
-	syms Syms
+	syms *Syms
 	tgid int
 }
 
@@ -396,7 +512,7 @@ func NewSymsCache() *SymsCache {
 func (s *SymsCache) GetSyms(tgid int) (*Syms, error) {
 	for _, d := range s.data {
 		if d.tgid == tgid {
-			return &d.syms, nil
+			return d.syms, nil
 		}
 	}
 
@@ -405,7 +521,7 @@ func (s *SymsCache) GetSyms(tgid int) (*Syms, error) {
 		return nil, err
 	}
 	s.data = append(s.data, SymsCacheData{
-		syms: *syms,
+		syms: syms,
 		tgid: tgid,
 	})
 	return syms, nil
@@ -415,13 +531,21 @@ func (s *Syms) addDso(m addrMap, name string) error {
 	var d *Dso
 	for _, item := range s.dsos {
 		if item.name == name {
-			d = &item
+			d = item
+			break
 		}
 	}
-	if d == nil {
-		d = &Dso{
-			name: name,
-		}
+	if d != nil {
+		d.ranges = append(d.ranges, LoadRange{
+			start:   m.startAddr,
+			end:     m.endAddr,
+			fileOff: m.fileOff,
+		})
+		return nil
+	}
+
+	d = &Dso{
+		name: name,
 	}
 	d.ranges = append(d.ranges, LoadRange{
 		start:   m.startAddr,
@@ -429,27 +553,30 @@ func (s *Syms) addDso(m addrMap, name string) error {
 		fileOff: m.fileOff,
 	})
 
-	elfType, err := getElfType(name)
-	if err != nil {
-		return err
-	}
-	if elfType == elf.ET_EXEC {
-		d._type = EXEC
-	} else if elfType == elf.ET_DYN {
-		d._type = DYN
-		var err error
-		d.shAddr, d.shOffset, err = getElfTextScnInfo(name)
-		if err != nil {
-			return err
-		}
-	} else if isPerfMap(name) {
+	if isPerfMap(name) {
 		d._type = PERF_MAP
 	} else if isVdso(name) {
 		d._type = VDSO
 	} else {
-		d._type = UNKNOWN
+		elfType, err := getElfType(name)
+		if err != nil {
+			return err
+		}
+		if elfType == elf.ET_EXEC {
+			d._type = EXEC
+		} else if elfType == elf.ET_DYN {
+			d._type = DYN
+			var err error
+			d.shAddr, d.shOffset, err = getElfTextScnInfo(name)
+			if err != nil {
+				return err
+			}
+		} else {
+			d._type = UNKNOWN
+		}
 	}
 
+	s.dsos = append(s.dsos, d)
 	return nil
 }
 
@@ -493,31 +620,195 @@ type addrMap struct {
 	inode     uint64
 }
 
+func parseAddrMapLine(line string) (addrMap, string, string, error) {
+	var m addrMap
+	var name string
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return m, "", "", fmt.Errorf("invalid maps line: %s", line)
+	}
+	if len(fields) > 5 {
+		name = strings.Join(fields[5:], " ")
+	}
+	if _, err := fmt.Sscanf(fields[0], "%x-%x", &m.startAddr, &m.endAddr); err != nil {
+		return m, "", "", err
+	}
+	perm := fields[1]
+	if _, err := fmt.Sscanf(fields[2], "%x", &m.fileOff); err != nil {
+		return m, "", "", err
+	}
+	if _, err := fmt.Sscanf(fields[3], "%x:%x", &m.devMajor, &m.devMinor); err != nil {
+		return m, "", "", err
+	}
+	if _, err := fmt.Sscanf(fields[4], "%d", &m.inode); err != nil {
+		return m, "", "", err
+	}
+	return m, perm, name, nil
+}
+
+// GetPidLibPath returns the path of the shared library lib (e.g. "c" for
+// libc) mapped by process pid, or the one used by the system if pid is 0.
+// The library of a process is seen through its root, as /proc/<pid>/root/...,
+// so that the path is usable from outside the mount namespace of the process.
+func GetPidLibPath(pid int, lib string) (string, error) {
+	if pid <= 0 {
+		return systemLibPath(lib)
+	}
+	paths, err := pidLibPaths(strconv.Itoa(pid), lib)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("lib%s is not mapped by process %d", lib, pid)
+	}
+	path := filepath.Join(fmt.Sprintf("/proc/%d/root", pid), paths[0])
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// systemLibPath returns the path of lib mapped by init, as seen from its
+// root, or else the one known to ldconfig. The tools are linked statically,
+// so the libraries mapped by the current process are of no use.
+func systemLibPath(lib string) (string, error) {
+	if paths, err := pidLibPaths("1", lib); err == nil && len(paths) > 0 {
+		path := filepath.Join("/proc/1/root", paths[0])
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	out, err := exec.Command("ldconfig", "-p").Output()
+	if err != nil {
+		return "", fmt.Errorf("lib%s is not mapped by init and ldconfig failed: %w", lib, err)
+	}
+	for _, path := range parseLdconfigCache(out, lib) {
+		if sameELFMachine(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("lib%s is not found", lib)
+}
+
+// parseLdconfigCache returns the paths of lib listed in the output of
+// ldconfig -p, whose lines look like:
+//
+//	libc.so.6 (libc6,x86-64) => /lib/x86_64-linux-gnu/libc.so.6
+func parseLdconfigCache(out []byte, lib string) []string {
+	var paths []string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[len(fields)-2] != "=>" {
+			continue
+		}
+		path := fields[len(fields)-1]
+		if isLibName(fields[0], lib) && !Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// sameELFMachine reports whether the ELF file at path is built for the same
+// machine as the current process, as ldconfig also lists 32-bit libraries.
+func sameELFMachine(path string) bool {
+	self, err := elf.Open("/proc/self/exe")
+	if err != nil {
+		return true
+	}
+	defer self.Close()
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return f.Class == self.Class && f.Machine == self.Machine
+}
+
+// GetLibPaths returns the paths of the shared library lib mapped by any
+// process, as seen from the root of each process.
+func GetLibPaths(lib string) ([]string, error) {
+	procs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	seen := map[string]bool{}
+	for _, proc := range procs {
+		paths, err := pidLibPaths(filepath.Base(proc), lib)
+		if err != nil {
+			/* the process may have exited */
+			continue
+		}
+		for _, path := range paths {
+			path = filepath.Join(proc, "root", path)
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			/* the same library may be seen through the root of many processes */
+			st, ok := fi.Sys().(*syscall.Stat_t)
+			if !ok {
+				continue
+			}
+			key := fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			ret = append(ret, path)
+		}
+	}
+	return ret, nil
+}
+
+func pidLibPaths(procPid string, lib string) ([]string, error) {
+	fdata, err := os.ReadFile(fmt.Sprintf("/proc/%s/maps", procPid))
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	s := bufio.NewScanner(bytes.NewReader(fdata))
+	for s.Scan() {
+		_, _, name, err := parseAddrMapLine(strings.TrimSpace(s.Text()))
+		if err != nil || !strings.HasPrefix(name, "/") || Contains(paths, name) {
+			continue
+		}
+		if isLibName(filepath.Base(name), lib) {
+			paths = append(paths, name)
+		}
+	}
+	return paths, nil
+}
+
+// isLibName reports whether name is the file name of lib, but not of another
+// library sharing its prefix like libgnutls-dane.so for gnutls.
+func isLibName(name string, lib string) bool {
+	/* match both libc.so.6 and libc-2.31.so */
+	if strings.HasPrefix(name, "lib"+lib+".so") {
+		return true
+	}
+	version := strings.TrimPrefix(name, "lib"+lib+"-")
+	return version != name && version != "" && version[0] >= '0' && version[0] <= '9'
+}
+
 func symsLoadFile(name string) (*Syms, error) {
 	fdata, err := os.ReadFile(name)
 	if err != nil {
 		return nil, err
 	}
-	var syms *Syms
+	syms := &Syms{}
 	s := bufio.NewScanner(bytes.NewReader(fdata))
 	for s.Scan() {
 		line := strings.TrimSpace(s.Text())
 		if line == "" {
 			continue
 		}
-		var addrMap addrMap
-		var perm string
-		var name string
-		n, err := fmt.Fscanf(strings.NewReader(line),
-			"%x-%x %4s %x %x:%x %u%s",
-			&addrMap.startAddr, &addrMap.endAddr, &perm, &addrMap.fileOff,
-			&addrMap.devMajor, &addrMap.devMinor, &addrMap.inode, &name)
+		addrMap, perm, name, err := parseAddrMapLine(line)
 		if err != nil {
 			return nil, err
 		}
-		if n == 0 {
-			continue
-		}
 		if len(perm) < 3 || perm[2] != 'x' {
 			continue
 		}
@@ -525,10 +816,11 @@ func symsLoadFile(name string) (*Syms, error) {
 			continue
 		}
 		if isVdso(name) {
-			break
+			continue
 		}
 		if err := syms.addDso(addrMap, name); err != nil {
-			return nil, err
+			/* the file may be deleted or not readable, skip it */
+			continue
 		}
 	}
 
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymsCache_GetSyms(t *testing.T) {
+	cache := NewSymsCache()
+	syms, err := cache.GetSyms(os.Getpid())
+	if err != nil {
+		t.Fatalf("GetSyms() error = %v", err)
+	}
+	if got, _ := cache.GetSyms(os.Getpid()); got != syms {
+		t.Errorf("GetSyms() did not return the cached syms")
+	}
+
+	var libc *Dso
+	for _, d := range syms.dsos {
+		if strings.Contains(filepath.Base(d.name), "libc.so") {
+			libc = d
+		}
+	}
+	if libc == nil || libc._type != DYN {
+		t.Skip("libc is not mapped")
+	}
+	f, err := elf.Open(libc.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dynSyms, err := f.DynamicSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value uint64
+	for _, s := range dynSyms {
+		if s.Name == "getpid" {
+			value = s.Value
+		}
+	}
+	if value == 0 {
+		t.Skip("getpid is not found in libc")
+	}
+
+	/* reverse the translation done by findDso to get the runtime address */
+	fileOff := value - (libc.shAddr - libc.shOffset)
+	var addr uint64
+	for _, r := range libc.ranges {
+		if fileOff >= r.fileOff && fileOff < r.fileOff+(r.end-r.start) {
+			addr = r.start + fileOff - r.fileOff + 1
+		}
+	}
+	if addr == 0 {
+		t.Skip("getpid is not in an executable mapping")
+	}
+	sym := syms.MapAddr(addr)
+	if sym == nil {
+		t.Fatalf("MapAddr(%x) = nil", addr)
+	}
+	if !strings.HasSuffix(sym.Name, "getpid") || sym.Offset != 1 {
+		t.Errorf("MapAddr(%x) = %v+%d, want getpid+1", addr, sym.Name, sym.Offset)
+	}
+}
+
+func TestParseAddrMapLine(t *testing.T) {
+	line := "7f1c2a628000-7f1c2a7bd000 r-xp 00028000 fd:01 1835053                    /usr/lib/x86_64-linux-gnu/libc.so.6"
+	m, perm, name, err := parseAddrMapLine(line)
+	if err != nil {
+		t.Fatalf("parseAddrMapLine() error = %v", err)
+	}
+	want := addrMap{
+		startAddr: 0x7f1c2a628000,
+		endAddr:   0x7f1c2a7bd000,
+		fileOff:   0x28000,
+		devMajor:  0xfd,
+		devMinor:  0x01,
+		inode:     1835053,
+	}
+	if m != want {
+		t.Errorf("parseAddrMapLine() got = %+v, want %+v", m, want)
+	}
+	if perm != "r-xp" {
+		t.Errorf("parseAddrMapLine() perm = %v, want r-xp", perm)
+	}
+	if name != "/usr/lib/x86_64-linux-gnu/libc.so.6" {
+		t.Errorf("parseAddrMapLine() name = %v", name)
+	}
+}
+
+func TestGetPidLibPath(t *testing.T) {
+	path, err := GetPidLibPath(os.Getpid(), "c")
+	if err != nil {
+		t.Skipf("libc is not mapped: %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(path), "libc") {
+		t.Errorf("GetPidLibPath(%d) = %s, want a libc path", os.Getpid(), path)
+	}
+	if root := fmt.Sprintf("/proc/%d/root/", os.Getpid()); !strings.HasPrefix(path, root) {
+		t.Errorf("GetPidLibPath(%d) = %s, want a path under %s", os.Getpid(), path, root)
+	}
+	if _, err := GetPidLibPath(os.Getpid(), "no-such-lib"); err == nil {
+		t.Errorf("GetPidLibPath() expected an error for a library that is not mapped")
+	}
+
+	sys, err := GetPidLibPath(0, "c")
+	if err != nil {
+		t.Fatalf("GetPidLibPath(0) error = %v", err)
+	}
+	if !strings.HasPrefix(filepath.Base(sys), "libc") {
+		t.Errorf("GetPidLibPath(0) = %s, want a libc path", sys)
+	}
+	if _, err := os.Stat(sys); err != nil {
+		t.Errorf("GetPidLibPath(0) = %s: %v", sys, err)
+	}
+}
+
+func TestIsLibName(t *testing.T) {
+	tests := []struct {
+		name string
+		lib  string
+		want bool
+	}{
+		{"libc.so.6", "c", true},
+		{"libc-2.31.so", "c", true},
+		{"libc.so", "c", true},
+		{"libcrypt.so.1", "c", false},
+		{"libc_malloc_debug.so.0", "c", false},
+		{"libgnutls.so.30", "gnutls", true},
+		{"libgnutls-dane.so.0", "gnutls", false},
+		{"libgnutls-openssl.so.27", "gnutls", false},
+		{"libssl.so.3", "ssl", true},
+		{"libssl3.so", "ssl", false},
+		{"libssl-", "ssl", false},
+	}
+	for _, tt := range tests {
+		if got := isLibName(tt.name, tt.lib); got != tt.want {
+			t.Errorf("isLibName(%s, %s) = %v, want %v", tt.name, tt.lib, got, tt.want)
+		}
+	}
+}
+
+func TestParseLdconfigCache(t *testing.T) {
+	out := []byte(`1234 libs found in cache ` + "`/etc/ld.so.cache'" + `
+	libcrypt.so.1 (libc6,x86-64) => /lib/x86_64-linux-gnu/libcrypt.so.1
+	libc.so.6 (libc6,x86-64, OS ABI: Linux 3.2.0) => /lib/x86_64-linux-gnu/libc.so.6
+	libc.so.6 (libc6) => /lib/i386-linux-gnu/libc.so.6
+	libc.so (libc6,x86-64) => /lib/x86_64-linux-gnu/libc.so
+`)
+	got := parseLdconfigCache(out, "c")
+	want := []string{
+		"/lib/x86_64-linux-gnu/libc.so.6",
+		"/lib/i386-linux-gnu/libc.so.6",
+		"/lib/x86_64-linux-gnu/libc.so",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("parseLdconfigCache() = %v, want %v", got, want)
+	}
+}
+
+func TestGetLibPaths(t *testing.T) {
+	libc, err := GetPidLibPath(os.Getpid(), "c")
+	if err != nil {
+		t.Skipf("libc is not mapped: %v", err)
+	}
+	want, err := os.Stat(libc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := GetLibPaths("c")
+	if err != nil {
+		t.Fatalf("GetLibPaths() error = %v", err)
+	}
+	found := false
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && os.SameFile(fi, want) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("GetLibPaths() = %v, want %s to be included", paths, libc)
+	}
+}
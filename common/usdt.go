@@ -0,0 +1,446 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	USDT_ARG_CONST = iota
+	USDT_ARG_REG
+	USDT_ARG_REG_DEREF
+)
+
+const (
+	usdtNoteSection = ".note.stapsdt"
+	usdtBaseSection = ".stapsdt.base"
+	usdtNoteName    = "stapsdt"
+	usdtNoteType    = 3
+)
+
+// USDTArg is a decoded USDT argument spec like "-4@-20(%rbp)".
+type USDTArg struct {
+	Kind   int
+	Size   int
+	Signed bool
+	/* the register and its offset in struct pt_regs */
+	Reg    string
+	RegOff int
+	/* the offset to dereference for USDT_ARG_REG_DEREF */
+	Offset int64
+	/* the value for USDT_ARG_CONST */
+	Value int64
+}
+
+// USDTNote is a USDT probe found in the .note.stapsdt section of an ELF.
+type USDTNote struct {
+	Path     string
+	Provider string
+	Name     string
+	ArgsSpec string
+	/* link time addresses, adjusted for prelinking */
+	Addr      uint64
+	Semaphore uint64
+	/* file offsets, FileOffset is the offset to attach a uprobe at */
+	FileOffset      uint64
+	SemaphoreOffset uint64
+}
+
+func (n *USDTNote) String() string {
+	return fmt.Sprintf("%s:%s", n.Provider, n.Name)
+}
+
+// Args decodes the argument specs of the probe. They are not decoded with
+// the note, as some addressing modes are not supported and most tools don't
+// read the arguments at all.
+func (n *USDTNote) Args() ([]USDTArg, error) {
+	args, err := ParseUSDTArgs(n.ArgsSpec)
+	if err != nil {
+		return nil, fmt.Errorf("probe %s: %w", n, err)
+	}
+	return args, nil
+}
+
+// ParseUSDTNotes returns all the USDT probes defined in the ELF at path.
+func ParseUSDTNotes(path string) ([]USDTNote, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sec := f.Section(usdtNoteSection)
+	if sec == nil {
+		return nil, fmt.Errorf("%s has no %s section", path, usdtNoteSection)
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+	var base uint64
+	if s := f.Section(usdtBaseSection); s != nil {
+		base = s.Addr
+	}
+
+	var notes []USDTNote
+	for len(data) > 0 {
+		note, rest, err := parseUSDTNote(data, f.ByteOrder, base)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		data = rest
+		if note == nil {
+			continue
+		}
+		note.Path = path
+		if note.FileOffset, err = elfAddrToOffset(f, note.Addr); err != nil {
+			return nil, fmt.Errorf("%s: probe %s: %w", path, note, err)
+		}
+		if note.Semaphore != 0 {
+			if note.SemaphoreOffset, err = elfAddrToOffset(f, note.Semaphore); err != nil {
+				return nil, fmt.Errorf("%s: semaphore of %s: %w", path, note, err)
+			}
+		}
+		notes = append(notes, *note)
+	}
+	return notes, nil
+}
+
+// FindUSDTNote returns the USDT probe provider:name defined in the ELF at path.
+func FindUSDTNote(path, provider, name string) (*USDTNote, error) {
+	notes, err := ParseUSDTNotes(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range notes {
+		n := n
+		if n.Provider == provider && n.Name == name {
+			return &n, nil
+		}
+	}
+	return nil, fmt.Errorf("usdt probe %s:%s is not found in %s", provider, name, path)
+}
+
+func alignNote(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// parseUSDTNote parses the first note in data and returns the rest of data.
+// A nil note is returned for notes which aren't USDT probes. base is the
+// address of the .stapsdt.base section, or 0 if there is no such section.
+func parseUSDTNote(data []byte, order binary.ByteOrder, base uint64) (*USDTNote, []byte, error) {
+	if len(data) < 12 {
+		return nil, nil, errors.New("truncated note header")
+	}
+	namesz := order.Uint32(data[0:4])
+	descsz := order.Uint32(data[4:8])
+	typ := order.Uint32(data[8:12])
+	data = data[12:]
+	nameEnd := alignNote(namesz)
+	descEnd := nameEnd + alignNote(descsz)
+	if uint64(len(data)) < uint64(nameEnd)+uint64(alignNote(descsz)) {
+		return nil, nil, errors.New("truncated note")
+	}
+	name := strings.TrimRight(string(data[:namesz]), "\x00")
+	desc := data[nameEnd : nameEnd+descsz]
+	rest := data[descEnd:]
+	if name != usdtNoteName || typ != usdtNoteType {
+		return nil, rest, nil
+	}
+
+	/* pc, base and semaphore addresses followed by provider, name and args */
+	if len(desc) < 24 {
+		return nil, nil, errors.New("truncated usdt note")
+	}
+	note := &USDTNote{
+		Addr:      order.Uint64(desc[0:8]),
+		Semaphore: order.Uint64(desc[16:24]),
+	}
+	strs := strings.SplitN(string(desc[24:]), "\x00", 4)
+	if len(strs) < 3 {
+		return nil, nil, errors.New("invalid usdt note strings")
+	}
+	note.Provider, note.Name, note.ArgsSpec = strs[0], strs[1], strs[2]
+
+	/* the binary has been prelinked, adjust the addresses */
+	if noteBase := order.Uint64(desc[8:16]); base != 0 && noteBase != 0 {
+		note.Addr += base - noteBase
+		if note.Semaphore != 0 {
+			note.Semaphore += base - noteBase
+		}
+	}
+	return note, rest, nil
+}
+
+func elfAddrToOffset(f *elf.File, addr uint64) (uint64, error) {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if addr >= p.Vaddr && addr < p.Vaddr+p.Memsz {
+			return addr - p.Vaddr + p.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x is not in any loadable segment", addr)
+}
+
+// ParseUSDTArgs decodes the space separated argument specs of a USDT probe.
+func ParseUSDTArgs(spec string) ([]USDTArg, error) {
+	return parseUSDTArgs(spec, runtime.GOARCH)
+}
+
+func parseUSDTArgs(spec, arch string) ([]USDTArg, error) {
+	/* arm64 specs like "8@[sp, 16]" contain spaces */
+	var specs []string
+	for _, field := range strings.Fields(spec) {
+		if n := len(specs); n > 0 && strings.Count(specs[n-1], "[") > strings.Count(specs[n-1], "]") {
+			specs[n-1] += " " + field
+			continue
+		}
+		specs = append(specs, field)
+	}
+
+	var args []USDTArg
+	for _, s := range specs {
+		arg, err := parseUSDTArg(s, arch)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func parseUSDTArg(s, arch string) (USDTArg, error) {
+	var arg USDTArg
+	at := strings.IndexByte(s, '@')
+	if at < 0 {
+		return arg, fmt.Errorf("invalid usdt argument %q", s)
+	}
+	size, err := strconv.Atoi(s[:at])
+	if err != nil || size == 0 {
+		return arg, fmt.Errorf("invalid size of usdt argument %q", s)
+	}
+	arg.Signed = size < 0
+	if arg.Signed {
+		size = -size
+	}
+	switch size {
+	case 1, 2, 4, 8:
+		arg.Size = size
+	default:
+		return arg, fmt.Errorf("invalid size of usdt argument %q", s)
+	}
+
+	switch arch {
+	case "amd64":
+		err = parseUSDTArgX86(&arg, s[at+1:])
+	case "arm64":
+		err = parseUSDTArgArm64(&arg, s[at+1:])
+	default:
+		err = fmt.Errorf("usdt is not supported on %s", arch)
+	}
+	if err != nil {
+		return arg, fmt.Errorf("invalid usdt argument %q: %w", s, err)
+	}
+	return arg, nil
+}
+
+// x86RegOffsets are the offsets of registers in the x86_64 struct pt_regs.
+var x86RegOffsets = map[string]int{
+	"r15": 0, "r14": 8, "r13": 16, "r12": 24, "bp": 32, "bx": 40,
+	"r11": 48, "r10": 56, "r9": 64, "r8": 72, "ax": 80, "cx": 88,
+	"dx": 96, "si": 104, "di": 112, "ip": 128, "sp": 152,
+}
+
+// x86RegName maps the names of sub registers like eax or r8d to the name of
+// the register in struct pt_regs.
+func x86RegName(name string) string {
+	if strings.HasPrefix(name, "r") && len(name) > 1 && name[1] >= '0' && name[1] <= '9' {
+		return strings.TrimRight(name, "dwb")
+	}
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "r"), "e")
+	switch name {
+	case "al":
+		return "ax"
+	case "bl":
+		return "bx"
+	case "cl":
+		return "cx"
+	case "dl":
+		return "dx"
+	case "sil":
+		return "si"
+	case "dil":
+		return "di"
+	case "bpl":
+		return "bp"
+	case "spl":
+		return "sp"
+	}
+	return name
+}
+
+func parseUSDTArgX86(arg *USDTArg, s string) error {
+	if strings.HasPrefix(s, "$") {
+		v, err := strconv.ParseInt(s[1:], 0, 64)
+		if err != nil {
+			return err
+		}
+		arg.Kind = USDT_ARG_CONST
+		arg.Value = v
+		return nil
+	}
+
+	arg.Kind = USDT_ARG_REG
+	if i := strings.IndexByte(s, '('); i >= 0 {
+		if !strings.HasSuffix(s, ")") || strings.Contains(s, ",") {
+			return errors.New("unsupported addressing mode")
+		}
+		if i > 0 {
+			off, err := strconv.ParseInt(s[:i], 0, 64)
+			if err != nil {
+				return err
+			}
+			arg.Offset = off
+		}
+		arg.Kind = USDT_ARG_REG_DEREF
+		s = s[i+1 : len(s)-1]
+	}
+	if !strings.HasPrefix(s, "%") {
+		return errors.New("missing register")
+	}
+	arg.Reg = x86RegName(s[1:])
+	off, ok := x86RegOffsets[arg.Reg]
+	if !ok {
+		return fmt.Errorf("unknown register %s", s)
+	}
+	arg.RegOff = off
+	return nil
+}
+
+func arm64RegOffset(name string) (int, bool) {
+	switch name {
+	case "sp":
+		return 31 * 8, true
+	case "pc":
+		return 32 * 8, true
+	}
+	if !strings.HasPrefix(name, "x") && !strings.HasPrefix(name, "w") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(name[1:])
+	if err != nil || n < 0 || n > 30 {
+		return 0, false
+	}
+	return n * 8, true
+}
+
+func parseUSDTArgArm64(arg *USDTArg, s string) error {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return errors.New("unsupported addressing mode")
+		}
+		parts := strings.Split(s[1:len(s)-1], ",")
+		if len(parts) > 2 {
+			return errors.New("unsupported addressing mode")
+		}
+		if len(parts) == 2 {
+			off, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 0, 64)
+			if err != nil {
+				return err
+			}
+			arg.Offset = off
+		}
+		arg.Kind = USDT_ARG_REG_DEREF
+		s = strings.TrimSpace(parts[0])
+	} else if v, err := strconv.ParseInt(s, 0, 64); err == nil {
+		arg.Kind = USDT_ARG_CONST
+		arg.Value = v
+		return nil
+	} else {
+		arg.Kind = USDT_ARG_REG
+	}
+	off, ok := arm64RegOffset(s)
+	if !ok {
+		return fmt.Errorf("unknown register %s", s)
+	}
+	arg.Reg = s
+	arg.RegOff = off
+	return nil
+}
+
+// semaphoreAddr returns the address of the semaphore of the probe in the
+// address space of process pid.
+func (n *USDTNote) semaphoreAddr(pid int) (uint64, error) {
+	fi, err := os.Stat(n.Path)
+	if err != nil {
+		return 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("failed to stat %s", n.Path)
+	}
+	fdata, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return 0, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(fdata))
+	for s.Scan() {
+		m, _, _, err := parseAddrMapLine(strings.TrimSpace(s.Text()))
+		if err != nil || m.inode != st.Ino {
+			continue
+		}
+		if n.SemaphoreOffset >= m.fileOff && n.SemaphoreOffset < m.fileOff+m.endAddr-m.startAddr {
+			return m.startAddr + n.SemaphoreOffset - m.fileOff, nil
+		}
+	}
+	return 0, fmt.Errorf("semaphore of %s is not mapped by process %d", n, pid)
+}
+
+func (n *USDTNote) addSemaphore(pid int, delta int) error {
+	if n.Semaphore == 0 {
+		return nil
+	}
+	addr, err := n.semaphoreAddr(pid)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", pid), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 2)
+	if _, err := f.ReadAt(buf, int64(addr)); err != nil {
+		return err
+	}
+	/* the semaphore is a counter of the tracers using the probe */
+	count := int(binary.LittleEndian.Uint16(buf)) + delta
+	if count < 0 {
+		count = 0
+	}
+	binary.LittleEndian.PutUint16(buf, uint16(count))
+	_, err = f.WriteAt(buf, int64(addr))
+	return err
+}
+
+// EnableSemaphore increments the semaphore of the probe in process pid, so
+// that the probe is hit. Probes without a semaphore are always enabled.
+func (n *USDTNote) EnableSemaphore(pid int) error {
+	return n.addSemaphore(pid, 1)
+}
+
+// DisableSemaphore decrements the semaphore incremented by EnableSemaphore.
+func (n *USDTNote) DisableSemaphore(pid int) error {
+	return n.addSemaphore(pid, -1)
+}
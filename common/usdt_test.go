@@ -0,0 +1,151 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseUSDTArgs(t *testing.T) {
+	tests := []struct {
+		spec string
+		arch string
+		want []USDTArg
+	}{
+		{
+			spec: "-4@%esi 8@-24(%rbp) 8@%r12 -1@$5",
+			arch: "amd64",
+			want: []USDTArg{
+				{Kind: USDT_ARG_REG, Size: 4, Signed: true, Reg: "si", RegOff: 104},
+				{Kind: USDT_ARG_REG_DEREF, Size: 8, Reg: "bp", RegOff: 32, Offset: -24},
+				{Kind: USDT_ARG_REG, Size: 8, Reg: "r12", RegOff: 24},
+				{Kind: USDT_ARG_CONST, Size: 1, Signed: true, Value: 5},
+			},
+		},
+		{
+			spec: "8@(%rax) 2@%r8w",
+			arch: "amd64",
+			want: []USDTArg{
+				{Kind: USDT_ARG_REG_DEREF, Size: 8, Reg: "ax", RegOff: 80},
+				{Kind: USDT_ARG_REG, Size: 2, Reg: "r8", RegOff: 72},
+			},
+		},
+		{
+			spec: "-4@w1 8@[sp, 16] 8@[x2] 4@7",
+			arch: "arm64",
+			want: []USDTArg{
+				{Kind: USDT_ARG_REG, Size: 4, Signed: true, Reg: "w1", RegOff: 8},
+				{Kind: USDT_ARG_REG_DEREF, Size: 8, Reg: "sp", RegOff: 248, Offset: 16},
+				{Kind: USDT_ARG_REG_DEREF, Size: 8, Reg: "x2", RegOff: 16},
+				{Kind: USDT_ARG_CONST, Size: 4, Value: 7},
+			},
+		},
+		{
+			spec: "",
+			arch: "amd64",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseUSDTArgs(tt.spec, tt.arch)
+		if err != nil {
+			t.Errorf("parseUSDTArgs(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseUSDTArgs(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"%rdi", "3@%rdi", "8@%xyz", "8@8(%rax,%rbx,4)"} {
+		if _, err := parseUSDTArgs(spec, "amd64"); err == nil {
+			t.Errorf("parseUSDTArgs(%q) expected an error", spec)
+		}
+	}
+}
+
+func buildNote(name string, typ uint32, desc []byte) []byte {
+	var buf bytes.Buffer
+	nameBytes := append([]byte(name), 0)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(nameBytes)))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(desc)))
+	binary.Write(&buf, binary.LittleEndian, typ)
+	buf.Write(nameBytes)
+	buf.Write(make([]byte, alignNote(uint32(len(nameBytes)))-uint32(len(nameBytes))))
+	buf.Write(desc)
+	buf.Write(make([]byte, alignNote(uint32(len(desc)))-uint32(len(desc))))
+	return buf.Bytes()
+}
+
+func TestParseUSDTNote(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the test note uses x86 argument specs")
+	}
+	var desc bytes.Buffer
+	binary.Write(&desc, binary.LittleEndian, []uint64{0x1100, 0x2000, 0x4000})
+	desc.WriteString("hotspot\x00gc__begin\x00-1@%al\x00")
+
+	data := append(buildNote("GNU", 1, []byte{1, 2, 3}), buildNote(usdtNoteName, usdtNoteType, desc.Bytes())...)
+	note, rest, err := parseUSDTNote(data, binary.LittleEndian, 0x2000)
+	if err != nil || note != nil {
+		t.Fatalf("parseUSDTNote() = %v, %v, want the GNU note to be skipped", note, err)
+	}
+	note, rest, err = parseUSDTNote(rest, binary.LittleEndian, 0x2100)
+	if err != nil {
+		t.Fatalf("parseUSDTNote() error = %v", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("parseUSDTNote() left %d bytes", len(rest))
+	}
+	want := &USDTNote{
+		Provider:  "hotspot",
+		Name:      "gc__begin",
+		ArgsSpec:  "-1@%al",
+		Addr:      0x1200,
+		Semaphore: 0x4100,
+	}
+	if !reflect.DeepEqual(note, want) {
+		t.Errorf("parseUSDTNote() = %+v, want %+v", note, want)
+	}
+
+	args, err := note.Args()
+	wantArgs := []USDTArg{{Kind: USDT_ARG_REG, Size: 1, Signed: true, Reg: "ax", RegOff: 80}}
+	if err != nil || !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("Args() = %+v, %v, want %+v", args, err, wantArgs)
+	}
+
+	/* a probe with unsupported args is still parsed */
+	desc.Reset()
+	binary.Write(&desc, binary.LittleEndian, []uint64{0x1100, 0, 0})
+	desc.WriteString("hotspot\x00gc__end\x008@8(%rax,%rbx,4)\x00")
+	note, _, err = parseUSDTNote(buildNote(usdtNoteName, usdtNoteType, desc.Bytes()), binary.LittleEndian, 0)
+	if err != nil || note == nil || note.Name != "gc__end" {
+		t.Fatalf("parseUSDTNote() = %+v, %v, want gc__end", note, err)
+	}
+	if _, err := note.Args(); err == nil {
+		t.Errorf("Args() expected an error for %q", note.ArgsSpec)
+	}
+
+	if _, _, err := parseUSDTNote(data[:8], binary.LittleEndian, 0); err == nil {
+		t.Errorf("parseUSDTNote() expected an error for a truncated note")
+	}
+}
+
+func TestParseUSDTNotes(t *testing.T) {
+	libc, err := GetPidLibPath(os.Getpid(), "c")
+	if err != nil {
+		t.Skip("libc is not mapped")
+	}
+	notes, err := ParseUSDTNotes(libc)
+	if err != nil {
+		t.Skipf("libc has no usdt probes: %v", err)
+	}
+	for _, n := range notes {
+		if n.Provider == "" || n.Name == "" || n.FileOffset == 0 {
+			t.Errorf("invalid usdt note %+v", n)
+		}
+	}
+}
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/cachestat.bpf.c
\ No newline at end of file
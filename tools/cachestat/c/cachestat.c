@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/cachestat.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/cachestat.h
\ No newline at end of file
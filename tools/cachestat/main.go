@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+type Stats struct {
+	Total  int64
+	Misses int64
+	Mbd    uint64
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	timestamp  bool
+	interval   uint64
+	count      uint64
+}
+
+var opts = Options{
+	bpfObjPath: "cachestat.bpf.o",
+	verbose:    false,
+	timestamp:  false,
+	interval:   1,
+	count:      99999999,
+}
+
+// hooks maps each counting hook of cachestat.bpf.c to the kernel functions it
+// can trace, in order of preference. These functions were renamed to their
+// folio variants across kernel versions.
+var hooks = []struct {
+	name  string
+	funcs []string
+}{
+	{"add_to_page_cache_lru", []string{"add_to_page_cache_lru", "filemap_add_folio"}},
+	{"mark_page_accessed", []string{"mark_page_accessed", "folio_mark_accessed"}},
+	{"account_page_dirtied", []string{"account_page_dirtied", "folio_account_dirtied"}},
+	{"mark_buffer_dirty", []string{"mark_buffer_dirty"}},
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Print timestamp")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.count = uint64(count)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+}
+
+type attachPoint struct {
+	progName string
+	target   string
+}
+
+func findTarget(funcs []string, exists func(string) bool) string {
+	for _, f := range funcs {
+		if exists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// setAttachTargets resolves every hook to a program and a kernel function,
+// preferring fentry, then kprobe, and for dirtied pages falling back to the
+// writeback tracepoints. Programs that are not used are not loaded.
+func setAttachTargets(bpfModule *bpf.Module) []attachPoint {
+	var points []attachPoint
+	var disabled []string
+	dirtiedResolved := false
+	for _, hook := range hooks {
+		fentryProg := "fentry_" + hook.name
+		kprobeProg := "kprobe_" + hook.name
+		if target := findTarget(hook.funcs, common.FentryCanAttach); target != "" {
+			prog, err := bpfModule.GetProgram(fentryProg)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if err := prog.SetAttachTarget(0, target); err != nil {
+				log.Fatalln(err)
+			}
+			points = append(points, attachPoint{fentryProg, target})
+			disabled = append(disabled, kprobeProg)
+			if hook.name == "account_page_dirtied" {
+				dirtiedResolved = true
+			}
+			continue
+		}
+		disabled = append(disabled, fentryProg)
+		if target := findTarget(hook.funcs, common.KprobeExists); target != "" {
+			points = append(points, attachPoint{kprobeProg, target})
+			if hook.name == "account_page_dirtied" {
+				dirtiedResolved = true
+			}
+			continue
+		}
+		disabled = append(disabled, kprobeProg)
+		if hook.name != "account_page_dirtied" {
+			log.Fatalf("failed to find any of %s to trace", strings.Join(hook.funcs, ", "))
+		}
+	}
+
+	/* account_page_dirtied is not traceable on newer kernels, use the writeback tracepoints instead */
+	tracepoints := []string{"writeback_dirty_folio", "writeback_dirty_page"}
+	tracepoint := ""
+	if !dirtiedResolved {
+		tracepoint = findTarget(tracepoints, func(name string) bool {
+			return common.TracepointExists("writeback", name)
+		})
+		if tracepoint == "" {
+			log.Fatalln("failed to find a way to trace dirtied pages")
+		}
+		points = append(points, attachPoint{"tracepoint__" + tracepoint, tracepoint})
+	}
+	for _, name := range tracepoints {
+		if name != tracepoint {
+			disabled = append(disabled, "tracepoint__"+name)
+		}
+	}
+
+	for _, name := range disabled {
+		prog, err := bpfModule.GetProgram(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return points
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module, points []attachPoint) {
+	for _, p := range points {
+		prog, err := bpfModule.GetProgram(p.progName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if strings.HasPrefix(p.progName, "kprobe_") {
+			_, err = prog.AttachKprobe(p.target)
+		} else {
+			_, err = prog.AttachGeneric()
+		}
+		if err != nil {
+			log.Fatalf("failed to attach %s to %s: %s", p.progName, p.target, err)
+		}
+	}
+}
+
+func getMeminfo() (uint64, uint64, error) {
+	fdata, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	var buffers, cached uint64
+	s := bufio.NewScanner(bytes.NewReader(fdata))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *uint64
+		switch fields[0] {
+		case "Buffers:":
+			dst = &buffers
+		case "Cached:":
+			dst = &cached
+		default:
+			continue
+		}
+		if *dst, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return buffers, cached, nil
+}
+
+func printHeader() {
+	if opts.timestamp {
+		fmt.Printf("%-8s ", "TIME")
+	}
+	fmt.Printf("%8s %8s %8s %8s %12s %10s\n",
+		"HITS", "MISSES", "DIRTIES", "HITRATIO", "BUFFERS_MB", "CACHED_MB")
+}
+
+func printAndResetStats(bss *bpf.BPFMap) {
+	values, err := common.DumpThenClearArray(bss)
+	if err != nil {
+		log.Fatalf("failed to read stats: %s", err)
+	}
+	var stats Stats
+	if len(values) > 0 {
+		if err := binary.Read(bytes.NewReader(values[0]), binary.LittleEndian, &stats); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	total := stats.Total
+	misses := stats.Misses
+	if total < 0 {
+		total = 0
+	}
+	if misses < 0 {
+		misses = 0
+	}
+	hits := total - misses
+	/*
+	 * If hits are < 0, then its possible misses are overestimated
+	 * due to possibly page cache read ahead adding more pages than
+	 * needed. In this case just assume misses as total and reset
+	 * hits.
+	 */
+	if hits < 0 {
+		misses = total
+		hits = 0
+	}
+	var ratio float64
+	if total > 0 {
+		ratio = float64(hits) / float64(total)
+	}
+
+	buffers, cached, err := getMeminfo()
+	if err != nil {
+		log.Fatalf("failed to get meminfo: %s", err)
+	}
+	if opts.timestamp {
+		ts := time.Now().Format("15:04:05")
+		fmt.Printf("%-8s ", ts)
+	}
+	fmt.Printf("%8d %8d %8d %7.2f%% %12d %10d\n",
+		hits, misses, stats.Mbd, 100*ratio, buffers/1024, cached/1024)
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	points := setAttachTargets(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, points)
+
+	bss, err := bpfModule.GetMap(".bss")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	count := opts.count
+
+	printHeader()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		printAndResetStats(bss)
+
+		count--
+		if end || count == 0 {
+			break loop
+		}
+	}
+}
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/capable.bpf.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/capable.c
\ No newline at end of file
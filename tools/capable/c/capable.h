@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/capable.h
\ No newline at end of file
@@ -0,0 +1,3 @@
+module github.com/mozillazg/libbpfgo-tools/tools/capable/c
+
+go 1.17
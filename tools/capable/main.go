@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const TASK_COMM_LEN = 16
+
+const (
+	UNQ_OFF = iota
+	UNQ_PID
+	UNQ_CGROUP
+)
+
+var capNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+type CapEvent struct {
+	Pid     uint32
+	Cap     uint32
+	Tgid    uint32
+	Uid     uint32
+	Audit   int32
+	Insetid int32
+	Ret     int32
+	Task    [TASK_COMM_LEN]byte
+}
+
+type Key struct {
+	Pid         uint32
+	Tgid        uint32
+	UserStackId int32
+	KernStackId int32
+}
+
+type Options struct {
+	bpfObjPath        string
+	verbose           bool
+	pid               int32
+	cgroup            string
+	kernelStack       bool
+	userStack         bool
+	extraFields       bool
+	unique            string
+	perfMaxStackDepth uint32
+	stackStorageSize  uint32
+	uniqueType        int32
+}
+
+var opts = Options{
+	bpfObjPath:        "capable.bpf.o",
+	verbose:           false,
+	pid:               -1,
+	cgroup:            "",
+	kernelStack:       false,
+	userStack:         false,
+	extraFields:       false,
+	unique:            "",
+	perfMaxStackDepth: 127,
+	stackStorageSize:  1024,
+	uniqueType:        UNQ_OFF,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Trace this PID only")
+	flag.StringVarP(&opts.cgroup, "cgroup", "c", opts.cgroup, "Trace process in cgroup path")
+	flag.BoolVarP(&opts.kernelStack, "kernel-stack", "K", opts.kernelStack, "output kernel stack trace")
+	flag.BoolVarP(&opts.userStack, "user-stack", "U", opts.userStack, "output user stack trace")
+	flag.BoolVarP(&opts.extraFields, "extra", "x", opts.extraFields, "extra fields: show TID and INSETID columns")
+	flag.StringVar(&opts.unique, "unique", opts.unique,
+		"Print unique output for <pid> or <cgroup> (default: print every check)")
+	flag.Uint32Var(&opts.perfMaxStackDepth, "perf-max-stack-depth", opts.perfMaxStackDepth,
+		"the limit for both kernel and user stack traces (default 127)")
+	flag.Uint32Var(&opts.stackStorageSize, "stack-storage-size", opts.stackStorageSize,
+		"the number of unique stack traces that can be stored and displayed (default 1024)")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	switch opts.unique {
+	case "":
+		opts.uniqueType = UNQ_OFF
+	case "pid":
+		opts.uniqueType = UNQ_PID
+	case "cgroup":
+		opts.uniqueType = UNQ_CGROUP
+	default:
+		log.Fatalf("Unknown unique type %s, should be pid or cgroup\n", opts.unique)
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if err := bpfModule.InitGlobalVariable("my_pid", int32(os.Getpid())); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.pid >= 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.cgroup != "" {
+		if err := bpfModule.InitGlobalVariable("filter_cg", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.kernelStack {
+		if err := bpfModule.InitGlobalVariable("kernel_stack", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.userStack {
+		if err := bpfModule.InitGlobalVariable("user_stack", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.uniqueType != UNQ_OFF {
+		if err := bpfModule.InitGlobalVariable("unique_type", opts.uniqueType); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.SetValueSize(opts.perfMaxStackDepth * 8); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.Resize(opts.stackStorageSize); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+	if opts.cgroup != "" {
+		idx := 0
+		cgroupFd, err := common.GetCgroupDirFD(opts.cgroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cgroupMap, err := bpfModule.GetMap("cgroup_map")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := cgroupMap.Update(unsafe.Pointer(&idx), unsafe.Pointer(&cgroupFd)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func capName(c uint32) string {
+	if int(c) < len(capNames) {
+		return capNames[c]
+	}
+	return "?"
+}
+
+func getStack(stackmap *bpf.BPFMap, stackId int32) []uint64 {
+	if stackId < 0 {
+		return nil
+	}
+	rawStack, err := stackmap.GetValue(unsafe.Pointer(&stackId))
+	if err != nil {
+		return nil
+	}
+	var stack []uint64
+	for i := 0; i+8 <= len(rawStack); i += 8 {
+		addr := binary.LittleEndian.Uint64(rawStack[i : i+8])
+		if addr == 0 {
+			break
+		}
+		stack = append(stack, addr)
+	}
+	return stack
+}
+
+func printStacks(key Key, stackmap *bpf.BPFMap, ksyms *common.Ksyms, symsCache *common.SymsCache) {
+	if opts.kernelStack {
+		stack := getStack(stackmap, key.KernStackId)
+		if stack == nil {
+			fmt.Printf("    [Missed Kernel Stack]\n")
+		}
+		for _, addr := range stack {
+			name := "[unknown]"
+			if k := ksyms.MapAddr(addr); k != nil {
+				name = k.Name
+			}
+			fmt.Printf("    %#x %s\n", addr, name)
+		}
+	}
+	if opts.userStack {
+		if opts.kernelStack {
+			fmt.Printf("    --\n")
+		}
+		stack := getStack(stackmap, key.UserStackId)
+		if stack == nil {
+			fmt.Printf("    [Missed User Stack]\n")
+			return
+		}
+		syms, err := symsCache.GetSyms(int(key.Tgid))
+		for _, addr := range stack {
+			name := "[unknown]"
+			if err == nil {
+				if s := syms.MapAddr(addr); s != nil {
+					name = s.Name
+				}
+			}
+			fmt.Printf("    %#x %s\n", addr, name)
+		}
+	}
+	fmt.Printf("\n")
+}
+
+func printHeader() {
+	if opts.extraFields {
+		fmt.Printf("%-9s %-6s %-7s %-7s %-16s %-4s %-20s %-6s %-7s %s\n",
+			"TIME", "UID", "PID", "TID", "COMM", "CAP", "NAME", "AUDIT", "INSETID", "VERDICT")
+	} else {
+		fmt.Printf("%-9s %-6s %-7s %-16s %-4s %-20s %-6s %s\n",
+			"TIME", "UID", "PID", "COMM", "CAP", "NAME", "AUDIT", "VERDICT")
+	}
+}
+
+func printEvent(data []byte, info, stackmap *bpf.BPFMap, ksyms *common.Ksyms, symsCache *common.SymsCache) {
+	var key Key
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &key); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	rawValue, err := info.GetValue(unsafe.Pointer(&key))
+	if err != nil {
+		return
+	}
+	var e CapEvent
+	if err := binary.Read(bytes.NewReader(rawValue), binary.LittleEndian, &e); err != nil {
+		log.Fatalln(err)
+	}
+
+	verdict := "allow"
+	if e.Ret != 0 {
+		verdict = "deny"
+	}
+	ts := time.Now().Format("15:04:05")
+	if opts.extraFields {
+		fmt.Printf("%-9s %-6d %-7d %-7d %-16s %-4d %-20s %-6d %-7d %s\n",
+			ts, e.Uid, e.Tgid, e.Pid, common.GoString(e.Task[:]), e.Cap, capName(e.Cap),
+			e.Audit, e.Insetid, verdict)
+	} else {
+		fmt.Printf("%-9s %-6d %-7d %-16s %-4d %-20s %-6d %s\n",
+			ts, e.Uid, e.Tgid, common.GoString(e.Task[:]), e.Cap, capName(e.Cap),
+			e.Audit, verdict)
+	}
+	if opts.kernelStack || opts.userStack {
+		printStacks(key, stackmap, ksyms, symsCache)
+	}
+}
+
+func main() {
+	parseArgs()
+
+	ksyms, err := common.LoadKsyms()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	symsCache := common.NewSymsCache()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	info, err := bpfModule.GetMap("info")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	printHeader()
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data, info, stackmap, ksyms, symsCache)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_tracing.h>
+#include "compactsnoop.h"
+
+#define WMARK_MIN	0
+#define WMARK_LOW	1
+#define WMARK_HIGH	2
+
+const volatile pid_t targ_tgid = 0;
+const volatile pid_t targ_pid = 0;
+const volatile bool kernel_stack = false;
+
+/*
+ * direct compaction is reported with the gfp flags and order of the
+ * allocation which stalled, as passed to try_to_compact_pages
+ */
+struct alloc_t {
+	u32 gfp_flags;
+	s32 order;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u32);
+	__type(value, struct alloc_t);
+} allocs SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u32);
+	__type(value, struct event);
+} start SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u32);
+	__type(value, u64);
+} start_ts SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_STACK_TRACE);
+	__type(key, u32);
+} stackmap SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} events SEC(".maps");
+
+static bool trace_allowed(u64 pid_tgid)
+{
+	if (targ_tgid && targ_tgid != pid_tgid >> 32)
+		return false;
+	if (targ_pid && targ_pid != (u32)pid_tgid)
+		return false;
+	return true;
+}
+
+SEC("kprobe/try_to_compact_pages")
+int BPF_KPROBE(try_to_compact_pages, gfp_t gfp_mask, unsigned int order)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 tid = (u32)pid_tgid;
+	struct alloc_t alloc = {};
+
+	if (!trace_allowed(pid_tgid))
+		return 0;
+
+	alloc.gfp_flags = gfp_mask;
+	alloc.order = order;
+	bpf_map_update_elem(&allocs, &tid, &alloc, BPF_ANY);
+	return 0;
+}
+
+SEC("kretprobe/try_to_compact_pages")
+int BPF_KRETPROBE(try_to_compact_pages_ret)
+{
+	u32 tid = (u32)bpf_get_current_pid_tgid();
+
+	bpf_map_delete_elem(&allocs, &tid);
+	return 0;
+}
+
+SEC("kprobe/compact_zone")
+int BPF_KPROBE(compact_zone, struct compact_control *cc)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 tid = (u32)pid_tgid;
+	struct alloc_t *alloc;
+	struct event e = {};
+	struct zone *zone;
+
+	if (!trace_allowed(pid_tgid))
+		return 0;
+
+	zone = BPF_CORE_READ(cc, zone);
+	e.order = BPF_CORE_READ(cc, order);
+	e.gfp_flags = BPF_CORE_READ(cc, gfp_mask);
+	e.mode = BPF_CORE_READ(cc, mode);
+	e.nid = BPF_CORE_READ(zone, zone_pgdat, node_id);
+	bpf_probe_read_kernel_str(&e.zone, sizeof(e.zone), BPF_CORE_READ(zone, name));
+	bpf_core_read(&e.free, sizeof(e.free), &zone->vm_stat[NR_FREE_PAGES].counter);
+	bpf_core_read(&e.min, sizeof(e.min), &zone->_watermark[WMARK_MIN]);
+	bpf_core_read(&e.low, sizeof(e.low), &zone->_watermark[WMARK_LOW]);
+	bpf_core_read(&e.high, sizeof(e.high), &zone->_watermark[WMARK_HIGH]);
+
+	alloc = bpf_map_lookup_elem(&allocs, &tid);
+	if (alloc) {
+		e.gfp_flags = alloc->gfp_flags;
+		e.order = alloc->order;
+	}
+	bpf_map_update_elem(&start, &tid, &e, BPF_ANY);
+	return 0;
+}
+
+SEC("tracepoint/compaction/mm_compaction_begin")
+int mm_compaction_begin(void *ctx)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 tid = (u32)pid_tgid;
+	u64 ts;
+
+	if (!trace_allowed(pid_tgid))
+		return 0;
+
+	ts = bpf_ktime_get_ns();
+	bpf_map_update_elem(&start_ts, &tid, &ts, BPF_ANY);
+	return 0;
+}
+
+SEC("tracepoint/compaction/mm_compaction_end")
+int mm_compaction_end(struct trace_event_raw_mm_compaction_end *ctx)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 tid = (u32)pid_tgid;
+	struct event *e;
+	u64 *tsp;
+
+	tsp = bpf_map_lookup_elem(&start_ts, &tid);
+	if (!tsp)
+		return 0;
+	e = bpf_map_lookup_elem(&start, &tid);
+	if (!e)
+		goto cleanup;
+
+	e->delta_ns = bpf_ktime_get_ns() - *tsp;
+	e->status = ctx->status;
+	e->pid = pid_tgid >> 32;
+	e->kern_stack_id = kernel_stack ? bpf_get_stackid(ctx, &stackmap, 0) : -1;
+	bpf_get_current_comm(&e->comm, sizeof(e->comm));
+	bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+
+	bpf_map_delete_elem(&start, &tid);
+cleanup:
+	bpf_map_delete_elem(&start_ts, &tid);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,27 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __COMPACTSNOOP_H
+#define __COMPACTSNOOP_H
+
+#define TASK_COMM_LEN	16
+#define ZONE_NAME_LEN	16
+#define MAX_ENTRIES	10240
+
+struct event {
+	__u64 delta_ns;
+	/* watermarks and free pages of the zone at the start of compaction */
+	__u64 free;
+	__u64 min;
+	__u64 low;
+	__u64 high;
+	__u32 pid;
+	__u32 gfp_flags;
+	__s32 order;
+	__s32 nid;
+	__s32 mode;
+	__s32 status;
+	__s32 kern_stack_id;
+	char comm[TASK_COMM_LEN];
+	char zone[ZONE_NAME_LEN];
+};
+
+#endif /* __COMPACTSNOOP_H */
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN = 16
+	ZONE_NAME_LEN = 16
+)
+
+// gfpBitNames are the ___GFP_* flags in the order of their bits on kernels
+// before 6.10, which don't describe them in BTF. The ATOMIC bit is unused
+// since 6.3.
+var gfpBitNames = []string{
+	"DMA", "HIGHMEM", "DMA32", "MOVABLE", "RECLAIMABLE", "HIGH", "IO", "FS",
+	"ZERO", "ATOMIC", "DIRECT_RECLAIM", "KSWAPD_RECLAIM", "WRITE", "NOWARN",
+	"RETRY_MAYFAIL", "NOFAIL", "NORETRY", "MEMALLOC", "COMP", "NOMEMALLOC",
+	"HARDWALL", "THISNODE", "ACCOUNT", "ZEROTAGS",
+}
+
+type gfpFlag struct {
+	name string
+	mask uint32
+}
+
+type Event struct {
+	DeltaNs     uint64
+	Free        uint64
+	Min         uint64
+	Low         uint64
+	High        uint64
+	Pid         uint32
+	GfpFlags    uint32
+	Order       int32
+	Nid         int32
+	Mode        int32
+	Status      int32
+	KernStackId int32
+	Comm        [TASK_COMM_LEN]byte
+	Zone        [ZONE_NAME_LEN]byte
+	_           [4]byte
+}
+
+type Options struct {
+	bpfObjPath        string
+	verbose           bool
+	duration          uint32
+	extended          bool
+	pid               uint32
+	tid               uint32
+	kernelStack       bool
+	perfMaxStackDepth uint32
+	stackStorageSize  uint32
+}
+
+var opts = Options{
+	bpfObjPath:        "compactsnoop.bpf.o",
+	verbose:           false,
+	duration:          0,
+	extended:          false,
+	pid:               0,
+	tid:               0,
+	kernelStack:       false,
+	perfMaxStackDepth: 127,
+	stackStorageSize:  1024,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Uint32VarP(&opts.duration, "duration", "d", opts.duration, "Total duration of trace in seconds")
+	flag.BoolVarP(&opts.extended, "extended", "e", opts.extended, "Extended fields output")
+	flag.Uint32VarP(&opts.pid, "pid", "p", opts.pid, "Process ID to trace")
+	flag.Uint32VarP(&opts.tid, "tid", "t", opts.tid, "Thread TID to trace")
+	flag.BoolVarP(&opts.kernelStack, "kernel-stack", "K", opts.kernelStack, "Output kernel stack trace")
+	flag.Uint32Var(&opts.perfMaxStackDepth, "perf-max-stack-depth", opts.perfMaxStackDepth, "The limit for both kernel and user stack traces")
+	flag.Uint32Var(&opts.stackStorageSize, "stack-storage-size", opts.stackStorageSize, "The number of unique stack traces that can be stored and displayed")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_tgid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.tid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.tid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.kernelStack {
+		if err := bpfModule.InitGlobalVariable("kernel_stack", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.SetValueSize(opts.perfMaxStackDepth * 8); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.Resize(opts.stackStorageSize); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// kernelVersion returns the major and minor version of the running kernel.
+func kernelVersion() (int, int) {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return 0, 0
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	var major, minor int
+	fmt.Sscanf(string(release), "%d.%d", &major, &minor)
+	return major, minor
+}
+
+// loadGfpFlags returns the names of gfp flags and their combinations, in the
+// order in which the kernel prints them.
+func loadGfpFlags(btf *common.BTF) []gfpFlag {
+	bits := map[string]uint32{}
+	var fromBTF bool
+	if btf != nil {
+		_, err := btf.EnumValue("___GFP_DMA_BIT")
+		fromBTF = err == nil
+	}
+	major, minor := kernelVersion()
+	hasAtomic := major < 6 || (major == 6 && minor < 3)
+	for i, name := range gfpBitNames {
+		if !fromBTF {
+			/* the bit is left unused, so GFP_ATOMIC must not include it */
+			if name != "ATOMIC" || hasAtomic {
+				bits[name] = 1 << i
+			}
+			continue
+		}
+		if v, err := btf.EnumValue("___GFP_" + name + "_BIT"); err == nil {
+			bits[name] = 1 << v
+		}
+	}
+
+	reclaim := bits["DIRECT_RECLAIM"] | bits["KSWAPD_RECLAIM"]
+	kernel := reclaim | bits["IO"] | bits["FS"]
+	user := kernel | bits["HARDWALL"]
+	highuserMovable := user | bits["HIGHMEM"] | bits["MOVABLE"]
+	transhugeLight := (highuserMovable | bits["COMP"] | bits["NOMEMALLOC"] | bits["NOWARN"]) &^ reclaim
+
+	flags := []gfpFlag{
+		{"GFP_TRANSHUGE", transhugeLight | bits["DIRECT_RECLAIM"]},
+		{"GFP_TRANSHUGE_LIGHT", transhugeLight},
+		{"GFP_HIGHUSER_MOVABLE", highuserMovable},
+		{"GFP_HIGHUSER", user | bits["HIGHMEM"]},
+		{"GFP_USER", user},
+		{"GFP_KERNEL_ACCOUNT", kernel | bits["ACCOUNT"]},
+		{"GFP_KERNEL", kernel},
+		{"GFP_NOFS", reclaim | bits["IO"]},
+		{"GFP_ATOMIC", bits["HIGH"] | bits["ATOMIC"] | bits["KSWAPD_RECLAIM"]},
+		{"GFP_NOIO", reclaim},
+		{"GFP_NOWAIT", bits["KSWAPD_RECLAIM"]},
+	}
+	for _, name := range gfpBitNames {
+		if bits[name] != 0 {
+			flags = append(flags, gfpFlag{"__GFP_" + name, bits[name]})
+		}
+	}
+	return flags
+}
+
+func formatGfpFlags(flags []gfpFlag, v uint32) string {
+	if v == 0 {
+		return "0"
+	}
+	var names []string
+	for _, f := range flags {
+		if f.mask != 0 && v&f.mask == f.mask {
+			names = append(names, f.name)
+			v &^= f.mask
+		}
+	}
+	if v != 0 {
+		names = append(names, fmt.Sprintf("%#x", v))
+	}
+	return strings.Join(names, "|")
+}
+
+// enumNames returns the lowercased names of the enumerators of an enum,
+// without their common prefix, e.g. "complete" for COMPACT_COMPLETE.
+func enumNames(btf *common.BTF, name, prefix string) map[int32]string {
+	names := map[int32]string{}
+	if btf == nil {
+		return names
+	}
+	id, err := btf.FindByName(name, common.BTF_KIND_ENUM)
+	if err != nil {
+		return names
+	}
+	for _, v := range btf.TypeByID(id).EnumValues {
+		names[int32(v.Value)] = strings.ToLower(strings.TrimPrefix(v.Name, prefix))
+	}
+	return names
+}
+
+func enumName(names map[int32]string, v int32) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", v)
+}
+
+func getStack(stackmap *bpf.BPFMap, stackId int32) []uint64 {
+	if stackId < 0 {
+		return nil
+	}
+	rawStack, err := stackmap.GetValue(unsafe.Pointer(&stackId))
+	if err != nil {
+		return nil
+	}
+	var stack []uint64
+	for i := 0; i+8 <= len(rawStack); i += 8 {
+		addr := binary.LittleEndian.Uint64(rawStack[i : i+8])
+		if addr == 0 {
+			break
+		}
+		stack = append(stack, addr)
+	}
+	return stack
+}
+
+type printer struct {
+	gfpFlags []gfpFlag
+	modes    map[int32]string
+	results  map[int32]string
+	stackmap *bpf.BPFMap
+	ksyms    *common.Ksyms
+}
+
+func printHeader() {
+	fmt.Printf("%-8s %-16s %-7s %-4s %-8s %-5s %-10s %-8s %-16s",
+		"TIME", "COMM", "PID", "NODE", "ZONE", "ORDER", "MODE", "LAT(ms)", "STATUS")
+	if opts.extended {
+		fmt.Printf(" %-10s %-10s %-10s %-10s", "FREE", "MIN", "LOW", "HIGH")
+	}
+	fmt.Printf(" %s\n", "GFP")
+}
+
+func (p *printer) printEvent(data []byte) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("%-8s %-16s %-7d %-4d %-8s %-5d %-10s %-8.3f %-16s",
+		ts, common.GoString(e.Comm[:]), e.Pid, e.Nid, common.GoString(e.Zone[:]), e.Order,
+		enumName(p.modes, e.Mode), float64(e.DeltaNs)/1e6, enumName(p.results, e.Status))
+	if opts.extended {
+		fmt.Printf(" %-10d %-10d %-10d %-10d", e.Free, e.Min, e.Low, e.High)
+	}
+	fmt.Printf(" %s\n", formatGfpFlags(p.gfpFlags, e.GfpFlags))
+
+	if !opts.kernelStack {
+		return
+	}
+	stack := getStack(p.stackmap, e.KernStackId)
+	if stack == nil {
+		fmt.Printf("\t[Missed Kernel Stack]\n")
+	}
+	for _, addr := range stack {
+		if k := p.ksyms.MapAddr(addr); k != nil {
+			fmt.Printf("\t%s+%#x\n", k.Name, addr-k.Addr)
+		} else {
+			fmt.Printf("\t%#x\n", addr)
+		}
+	}
+	fmt.Printf("\n")
+}
+
+func main() {
+	parseArgs()
+
+	/* without BTF, gfp flags are decoded with the old layout and enums as numbers */
+	btf, _ := common.LoadVmlinuxBTF()
+	p := &printer{
+		gfpFlags: loadGfpFlags(btf),
+		modes:    enumNames(btf, "migrate_mode", "MIGRATE_"),
+		results:  enumNames(btf, "compact_result", "COMPACT_"),
+	}
+	var err error
+	if opts.kernelStack {
+		if p.ksyms, err = common.LoadKsyms(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	if p.stackmap, err = bpfModule.GetMap("stackmap"); err != nil {
+		log.Fatalln(err)
+	}
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	fmt.Printf("Tracing compact zone events")
+	if opts.duration > 0 {
+		var cancelFunc context.CancelFunc
+		ctx, cancelFunc = context.WithTimeout(ctx, time.Second*time.Duration(opts.duration))
+		defer cancelFunc()
+		fmt.Printf(" for %d secs.\n", opts.duration)
+	} else {
+		fmt.Print("... Hit Ctrl-C to end.\n")
+	}
+	printHeader()
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			p.printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
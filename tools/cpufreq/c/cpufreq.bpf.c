@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: GPL-2.0
+/*
+ * Based on cpufreq.bpf.c from bcc/libbpf-tools. The current frequencies and
+ * the system wide histogram live in array maps rather than in globals, so
+ * that userspace can initialize and read them through map operations.
+ */
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "cpufreq.h"
+#include "maps.bpf.h"
+
+const volatile bool filter_cg = false;
+
+static struct hist zero;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_CGROUP_ARRAY);
+	__type(key, u32);
+	__type(value, u32);
+	__uint(max_entries, 1);
+} cgroup_map SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, MAX_CPU_NR);
+	__type(key, u32);
+	__type(value, u32);
+} freqs_mhz SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, u32);
+	__type(value, struct hist);
+} syswide SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, struct hkey);
+	__type(value, struct hist);
+} hists SEC(".maps");
+
+static int handle_cpu_frequency(unsigned int state, u32 cpu_id)
+{
+	u32 freq_mhz = state / 1000;
+
+	if (cpu_id >= MAX_CPU_NR)
+		return 0;
+
+	bpf_map_update_elem(&freqs_mhz, &cpu_id, &freq_mhz, BPF_ANY);
+	return 0;
+}
+
+SEC("tp_btf/cpu_frequency")
+int BPF_PROG(cpu_frequency_btf, unsigned int state, unsigned int cpu_id)
+{
+	return handle_cpu_frequency(state, cpu_id);
+}
+
+SEC("raw_tp/cpu_frequency")
+int BPF_PROG(cpu_frequency, unsigned int state, unsigned int cpu_id)
+{
+	return handle_cpu_frequency(state, cpu_id);
+}
+
+SEC("perf_event")
+int do_sample(struct bpf_perf_event_data *ctx)
+{
+	u32 pid = bpf_get_current_pid_tgid();
+	u32 cpu = bpf_get_smp_processor_id();
+	u32 key = 0, *freq_mhz;
+	struct hist *hist;
+	struct hkey hkey;
+	u64 slot;
+
+	if (filter_cg && !bpf_current_task_under_cgroup(&cgroup_map, 0))
+		return 0;
+
+	freq_mhz = bpf_map_lookup_elem(&freqs_mhz, &cpu);
+	if (!freq_mhz || !*freq_mhz)
+		return 0;
+
+	/*
+	 * The range of the linear histogram is 0 ~ 5000mhz,
+	 * and the step size is 200.
+	 */
+	slot = *freq_mhz / HIST_STEP_SIZE;
+	if (slot >= MAX_SLOTS)
+		slot = MAX_SLOTS - 1;
+
+	hist = bpf_map_lookup_elem(&syswide, &key);
+	if (hist)
+		__sync_fetch_and_add(&hist->slots[slot], 1);
+	if (!pid)
+		return 0;
+
+	bpf_get_current_comm(&hkey.comm, sizeof(hkey.comm));
+	hist = bpf_map_lookup_or_try_init(&hists, &hkey, &zero);
+	if (!hist)
+		return 0;
+	__sync_fetch_and_add(&hist->slots[slot], 1);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
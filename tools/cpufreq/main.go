@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	MAX_CPU_NR     = 128
+	MAX_SLOTS      = 26
+	TASK_COMM_LEN  = 16
+	HIST_STEP_SIZE = 200
+)
+
+type Hist struct {
+	Slots [MAX_SLOTS]uint32
+}
+
+type CommHist struct {
+	Comm string
+	Hist Hist
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	duration   uint
+	freq       uint64
+	cgroup     string
+}
+
+var opts = Options{
+	bpfObjPath: "cpufreq.bpf.o",
+	verbose:    false,
+	duration:   0,
+	freq:       99,
+	cgroup:     "",
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.UintVarP(&opts.duration, "duration", "d", opts.duration, "Duration to trace")
+	flag.Uint64VarP(&opts.freq, "frequency", "f", opts.freq, "Sample with a certain frequency")
+	flag.StringVarP(&opts.cgroup, "cgroup", "c", opts.cgroup, "Trace process in cgroup path")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.freq == 0 {
+		log.Fatalln("Invalid freq (in hz): 0")
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.cgroup != "" {
+		if err := bpfModule.InitGlobalVariable("filter_cg", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) []string {
+	names := []string{"cpu_frequency"}
+	disabled := []string{"cpu_frequency_btf"}
+	if common.VmlinuxBTFExists() {
+		names, disabled = disabled, names
+	}
+	for _, name := range disabled {
+		prog, err := bpfModule.GetProgram(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return names
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+	if opts.cgroup != "" {
+		idx := 0
+		cgroupFd, err := common.GetCgroupDirFD(opts.cgroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cgroupMap, err := bpfModule.GetMap("cgroup_map")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := cgroupMap.Update(unsafe.Pointer(&idx), unsafe.Pointer(&cgroupFd)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// initFreqsMhz seeds the current frequency of every cpu, as the
+// cpu_frequency tracepoint only fires when a frequency changes.
+func initFreqsMhz(bpfModule *bpf.Module) {
+	cpus, err := bpf.NumPossibleCPUs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if cpus > MAX_CPU_NR {
+		cpus = MAX_CPU_NR
+	}
+	freqsMhz, err := bpfModule.GetMap("freqs_mhz")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var found bool
+	for cpu := 0; cpu < cpus; cpu++ {
+		path := fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq/scaling_cur_freq", cpu)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			/* offline cpus have no cpufreq directory */
+			continue
+		}
+		freqKhz, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			log.Fatalf("failed to parse %s: %s", path, err)
+		}
+		key := uint32(cpu)
+		freqMhz := uint32(freqKhz / 1000)
+		if err := freqsMhz.Update(unsafe.Pointer(&key), unsafe.Pointer(&freqMhz)); err != nil {
+			log.Fatalln(err)
+		}
+		found = true
+	}
+	if !found {
+		log.Fatalln("failed to read cpu frequencies, is cpufreq supported?")
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module, names []string) []int {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if !common.Contains(names, prog.Name()) {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	fds, err := common.OpenPerfEvents(common.PERF_TYPE_SOFTWARE, common.PERF_COUNT_SW_CPU_CLOCK, opts.freq)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	prog, err := bpfModule.GetProgram("do_sample")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, fd := range fds {
+		if _, err := prog.AttachPerfEvent(fd); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return fds
+}
+
+func histVals(hist Hist) []int {
+	var vals []int
+	for _, v := range hist.Slots {
+		vals = append(vals, int(v))
+	}
+	return vals
+}
+
+func printHists(hists, syswide *bpf.BPFMap) {
+	items, err := common.DumpHash(hists)
+	if err != nil {
+		log.Fatalf("failed to dump hists: %s", err)
+	}
+	var commHists []CommHist
+	for _, item := range items {
+		var h CommHist
+		h.Comm = common.GoString(item[0])
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &h.Hist); err != nil {
+			log.Fatalln(err)
+		}
+		commHists = append(commHists, h)
+	}
+	sort.Slice(commHists, func(i, j int) bool {
+		return commHists[i].Comm < commHists[j].Comm
+	})
+	for _, h := range commHists {
+		fmt.Printf("\n")
+		common.PrintLinearHist(histVals(h.Hist), 0, HIST_STEP_SIZE, h.Comm)
+	}
+
+	values, err := common.DumpArray(syswide)
+	if err != nil {
+		log.Fatalf("failed to dump syswide: %s", err)
+	}
+	var hist Hist
+	if len(values) > 0 {
+		if err := binary.Read(bytes.NewReader(values[0]), binary.LittleEndian, &hist); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	fmt.Printf("\n")
+	common.PrintLinearHist(histVals(hist), 0, HIST_STEP_SIZE, "syswide")
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	names := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	initFreqsMhz(bpfModule)
+	fds := attachPrograms(bpfModule, names)
+	defer common.ClosePerfEvents(fds)
+
+	hists, err := bpfModule.GetMap("hists")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	syswide, err := bpfModule.GetMap("syswide")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(opts.duration))
+		defer cancel()
+	}
+
+	fmt.Printf("Sampling CPU freq system-wide & by process. Ctrl-C to end.\n")
+	<-ctx.Done()
+
+	printHists(hists, syswide)
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_tracing.h>
+#include "dcstat.h"
+
+const volatile bool snoop = false;
+const volatile bool trace_all = false;
+const volatile pid_t targ_pid = 0;
+
+__u64 stats[S_MAXSTAT] = {};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u32);
+	__type(value, const unsigned char *);
+} start SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} events SEC(".maps");
+
+static __always_inline void inc_stats(int key)
+{
+	__atomic_add_fetch(&stats[key], 1, __ATOMIC_RELAXED);
+}
+
+static bool trace_allowed(u32 pid)
+{
+	return !targ_pid || targ_pid == pid;
+}
+
+static void submit_event(void *ctx, char type, const unsigned char *name)
+{
+	struct event e = {};
+
+	e.ts = bpf_ktime_get_ns();
+	e.pid = bpf_get_current_pid_tgid() >> 32;
+	e.type = type;
+	bpf_get_current_comm(&e.comm, sizeof(e.comm));
+	bpf_probe_read_kernel_str(&e.filename, sizeof(e.filename), name);
+	bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+}
+
+SEC("kprobe/lookup_fast")
+int BPF_KPROBE(lookup_fast, struct nameidata *nd)
+{
+	inc_stats(S_REFS);
+
+	if (snoop && trace_all && trace_allowed(bpf_get_current_pid_tgid() >> 32))
+		submit_event(ctx, LOOKUP_REFERENCE, BPF_CORE_READ(nd, last.name));
+	return 0;
+}
+
+SEC("kprobe/d_lookup")
+int BPF_KPROBE(d_lookup, const struct dentry *parent, const struct qstr *name)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 tid = (u32)pid_tgid;
+	const unsigned char *fname;
+
+	inc_stats(S_SLOW);
+
+	if (!snoop || !trace_allowed(pid_tgid >> 32))
+		return 0;
+	fname = BPF_CORE_READ(name, name);
+	bpf_map_update_elem(&start, &tid, &fname, BPF_ANY);
+	return 0;
+}
+
+SEC("kretprobe/d_lookup")
+int BPF_KRETPROBE(d_lookup_ret, struct dentry *ret)
+{
+	u32 tid = (u32)bpf_get_current_pid_tgid();
+	const unsigned char **fname;
+
+	if (!ret)
+		inc_stats(S_MISS);
+
+	if (!snoop)
+		return 0;
+	fname = bpf_map_lookup_elem(&start, &tid);
+	if (!fname)
+		return 0;
+	if (!ret)
+		submit_event(ctx, LOOKUP_MISS, *fname);
+	bpf_map_delete_elem(&start, &tid);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
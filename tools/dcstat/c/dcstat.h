@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __DCSTAT_H
+#define __DCSTAT_H
+
+#define TASK_COMM_LEN	16
+#define MAX_FILE_LEN	64
+#define MAX_ENTRIES	10240
+
+enum stat_types {
+	S_REFS = 0,
+	S_SLOW,
+	S_MISS,
+	S_MAXSTAT,
+};
+
+enum lookup_type {
+	LOOKUP_REFERENCE = 'R',
+	LOOKUP_MISS = 'M',
+};
+
+struct event {
+	__u64 ts;
+	__u32 pid;
+	char comm[TASK_COMM_LEN];
+	char type;
+	char filename[MAX_FILE_LEN];
+};
+
+#endif /* __DCSTAT_H */
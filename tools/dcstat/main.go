@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN = 16
+	MAX_FILE_LEN  = 64
+)
+
+const (
+	S_REFS = iota
+	S_SLOW
+	S_MISS
+	S_MAXSTAT
+)
+
+type Stats struct {
+	Values [S_MAXSTAT]uint64
+}
+
+type Event struct {
+	Ts       uint64
+	Pid      uint32
+	Comm     [TASK_COMM_LEN]byte
+	Type     byte
+	Filename [MAX_FILE_LEN]byte
+	_        [3]byte
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	snoop      bool
+	all        bool
+	pid        int32
+	interval   uint64
+	count      uint64
+}
+
+var opts = Options{
+	bpfObjPath: "dcstat.bpf.o",
+	verbose:    false,
+	snoop:      false,
+	all:        false,
+	pid:        0,
+	interval:   1,
+	count:      99999999,
+}
+
+var startTs uint64
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.snoop, "snoop", "s", opts.snoop, "Trace failed dcache lookups instead of printing statistics")
+	flag.BoolVarP(&opts.all, "all", "a", opts.all, "Trace all dcache lookups in snoop mode, not only failed ones")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Trace this PID only in snoop mode")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if !opts.snoop && (opts.all || opts.pid > 0) {
+		log.Fatalln("all and pid can only be used with snoop")
+	}
+	if args := flag.Args(); len(args) > 0 {
+		if opts.snoop {
+			log.Fatalln("interval and count cann't be used with snoop")
+		}
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.count = uint64(count)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if !opts.snoop {
+		return
+	}
+	if err := bpfModule.InitGlobalVariable("snoop", true); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.all {
+		if err := bpfModule.InitGlobalVariable("trace_all", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func printHeader() {
+	fmt.Printf("%-8s  %8s %8s %8s %8s\n", "TIME", "REFS/s", "SLOW/s", "MISS/s", "HIT%")
+}
+
+func printAndResetStats(bss *bpf.BPFMap) {
+	values, err := common.DumpThenClearArray(bss)
+	if err != nil {
+		log.Fatalf("failed to read stats: %s", err)
+	}
+	var stats Stats
+	if len(values) > 0 {
+		if err := binary.Read(bytes.NewReader(values[0]), binary.LittleEndian, &stats); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	refs := stats.Values[S_REFS]
+	miss := stats.Values[S_MISS]
+	hit := 0.0
+	if refs > 0 && refs >= miss {
+		hit = float64(refs-miss) * 100 / float64(refs)
+	}
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("%-8s: %8d %8d %8d %8.2f\n", ts,
+		refs/opts.interval, stats.Values[S_SLOW]/opts.interval, miss/opts.interval, hit)
+}
+
+func printEvent(data []byte) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	if startTs == 0 {
+		startTs = e.Ts
+	}
+	fmt.Printf("%-11.6f %-7d %-16s %c %s\n", float64(e.Ts-startTs)/1e9,
+		e.Pid, common.GoString(e.Comm[:]), e.Type, common.GoString(e.Filename[:]))
+}
+
+func runStat(ctx context.Context, bpfModule *bpf.Module) {
+	bss, err := bpfModule.GetMap(".bss")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	count := opts.count
+
+	printHeader()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		printAndResetStats(bss)
+
+		count--
+		if end || count == 0 {
+			break loop
+		}
+	}
+}
+
+func runSnoop(ctx context.Context, bpfModule *bpf.Module) {
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	defer func() {
+		pb.Stop()
+		pb.Close()
+	}()
+
+	fmt.Printf("%-11s %-7s %-16s %s %s\n", "TIME(s)", "PID", "COMM", "T", "FILE")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.snoop {
+		runSnoop(ctx, bpfModule)
+	} else {
+		runStat(ctx, bpfModule)
+	}
+}
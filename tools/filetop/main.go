@@ -2,16 +2,12 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
-	"os/signal"
 	"sort"
 	"strconv"
-	"syscall"
 	"time"
 	"unsafe"
 
@@ -243,36 +239,14 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer func() {
-		stop()
-	}()
-	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
-	var end bool
-	count := opts.count
-
-loop:
-	for {
-		select {
-		case <-ctx.Done():
-			end = true
-			break
-		case <-ticker.C:
-			break
-		}
-		if !opts.noclear {
-			cmd := exec.Command("clear")
-			cmd.Stdout = os.Stdout
-			if err := cmd.Run(); err != nil {
-				log.Fatalln(err)
-			}
-		}
-
+	err = common.RunTopLoop(common.TopLoopOptions{
+		Interval: opts.interval,
+		Count:    opts.count,
+		NoClear:  opts.noclear,
+	}, func() {
 		printStat(entries)
-
-		count--
-		if end || count == 0 {
-			break loop
-		}
+	})
+	if err != nil {
+		log.Fatalln(err)
 	}
 }
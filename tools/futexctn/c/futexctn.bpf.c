@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: GPL-2.0
+/* Based on futexctn.bpf.c from bcc/libbpf-tools, with a minimum latency. */
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "futexctn.h"
+#include "bits.bpf.h"
+#include "maps.bpf.h"
+
+#define MAX_ENTRIES		10240
+#define FUTEX_WAIT		0
+#define FUTEX_WAIT_BITSET	9
+#define FUTEX_PRIVATE_FLAG	128
+#define FUTEX_CLOCK_REALTIME	256
+#define FUTEX_CMD_MASK		~(FUTEX_PRIVATE_FLAG | FUTEX_CLOCK_REALTIME)
+
+const volatile pid_t targ_pid = 0;
+const volatile pid_t targ_tid = 0;
+const volatile u64 targ_lock = 0;
+const volatile u64 min_lat_ns = 0;
+const volatile bool targ_ms = false;
+
+struct val_t {
+	u64 ts;
+	u64 uaddr;
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_STACK_TRACE);
+	__type(key, u32);
+} stackmap SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u64);
+	__type(value, struct val_t);
+} start SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, struct hist_key);
+	__type(value, struct hist);
+} hists SEC(".maps");
+
+static struct hist initial_hist;
+
+SEC("tracepoint/syscalls/sys_enter_futex")
+int futex_enter(struct trace_event_raw_sys_enter *ctx)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 pid = pid_tgid >> 32;
+	u32 tid = (u32)pid_tgid;
+	struct val_t v = {};
+	int cmd = (int)ctx->args[1] & FUTEX_CMD_MASK;
+
+	if (cmd != FUTEX_WAIT && cmd != FUTEX_WAIT_BITSET)
+		return 0;
+	if (targ_pid && targ_pid != pid)
+		return 0;
+	if (targ_tid && targ_tid != tid)
+		return 0;
+
+	v.uaddr = ctx->args[0];
+	if (targ_lock && targ_lock != v.uaddr)
+		return 0;
+	v.ts = bpf_ktime_get_ns();
+	bpf_map_update_elem(&start, &pid_tgid, &v, BPF_ANY);
+	return 0;
+}
+
+SEC("tracepoint/syscalls/sys_exit_futex")
+int futex_exit(struct trace_event_raw_sys_exit *ctx)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	struct hist_key hkey = {};
+	struct hist *histp;
+	struct val_t *vp;
+	s64 delta;
+	u64 slot;
+
+	vp = bpf_map_lookup_elem(&start, &pid_tgid);
+	if (!vp)
+		return 0;
+	/* waits which time out or find the futex changed are not contention */
+	if ((int)ctx->ret < 0)
+		goto cleanup;
+
+	delta = (s64)(bpf_ktime_get_ns() - vp->ts);
+	if (delta < 0 || delta < min_lat_ns)
+		goto cleanup;
+
+	hkey.pid = pid_tgid >> 32;
+	hkey.uaddr = vp->uaddr;
+	hkey.user_stack_id = bpf_get_stackid(ctx, &stackmap, BPF_F_USER_STACK);
+
+	histp = bpf_map_lookup_or_try_init(&hists, &hkey, &initial_hist);
+	if (!histp)
+		goto cleanup;
+	bpf_get_current_comm(&histp->comm, sizeof(histp->comm));
+
+	if (targ_ms)
+		slot = log2l(delta / 1000000U);
+	else
+		slot = log2l(delta / 1000U);
+	if (slot >= MAX_SLOTS)
+		slot = MAX_SLOTS - 1;
+	__sync_fetch_and_add(&histp->slots[slot], 1);
+	__sync_fetch_and_add(&histp->contended, 1);
+	__sync_fetch_and_add(&histp->total_elapsed, delta);
+	if (!histp->min || delta < histp->min)
+		histp->min = delta;
+	if (delta > histp->max)
+		histp->max = delta;
+
+cleanup:
+	bpf_map_delete_elem(&start, &pid_tgid);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN = 16
+	MAX_SLOTS     = 36
+)
+
+type HistKey struct {
+	Uaddr       uint64
+	Pid         uint32
+	UserStackId int32
+}
+
+type Hist struct {
+	Slots        [MAX_SLOTS]uint32
+	Comm         [TASK_COMM_LEN]byte
+	Contended    uint64
+	TotalElapsed uint64
+	Min          uint64
+	Max          uint64
+}
+
+type Contention struct {
+	Key  HistKey
+	Hist Hist
+}
+
+type Options struct {
+	bpfObjPath        string
+	verbose           bool
+	pid               int32
+	tid               int32
+	lock              string
+	minLatency        uint64
+	milliseconds      bool
+	timestamp         bool
+	perfMaxStackDepth uint32
+	stackStorageSize  uint32
+	interval          uint64
+	times             uint64
+}
+
+var opts = Options{
+	bpfObjPath:        "futexctn.bpf.o",
+	verbose:           false,
+	pid:               0,
+	tid:               0,
+	lock:              "",
+	minLatency:        0,
+	milliseconds:      false,
+	timestamp:         false,
+	perfMaxStackDepth: 127,
+	stackStorageSize:  1024,
+	interval:          99999999,
+	times:             99999999,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Trace this PID only")
+	flag.Int32VarP(&opts.tid, "tid", "t", opts.tid, "Trace this TID only")
+	flag.StringVarP(&opts.lock, "lock", "l", opts.lock, "Trace this futex address only, e.g. 0x7f5a0c0008e0")
+	flag.Uint64Var(&opts.minLatency, "min-latency", opts.minLatency, "Only count waits of at least this many microseconds")
+	flag.BoolVarP(&opts.milliseconds, "milliseconds", "m", opts.milliseconds, "Millisecond histogram")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Include timestamp on output")
+	flag.Uint32Var(&opts.perfMaxStackDepth, "perf-max-stack-depth", opts.perfMaxStackDepth, "The limit for both kernel and user stack traces")
+	flag.Uint32Var(&opts.stackStorageSize, "stack-storage-size", opts.stackStorageSize, "The number of unique stack traces that can be stored and displayed")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			times, err := strconv.Atoi(args[1])
+			if err != nil || times <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.times = uint64(times)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.tid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_tid", opts.tid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.lock != "" {
+		lock, err := strconv.ParseUint(opts.lock, 0, 64)
+		if err != nil {
+			log.Fatalf("invalid lock address %s: %s", opts.lock, err)
+		}
+		if err := bpfModule.InitGlobalVariable("targ_lock", lock); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.minLatency > 0 {
+		if err := bpfModule.InitGlobalVariable("min_lat_ns", opts.minLatency*1000); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.milliseconds {
+		if err := bpfModule.InitGlobalVariable("targ_ms", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.SetValueSize(opts.perfMaxStackDepth * 8); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.Resize(opts.stackStorageSize); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func getStack(stackmap *bpf.BPFMap, stackId int32) []uint64 {
+	if stackId < 0 {
+		return nil
+	}
+	rawStack, err := stackmap.GetValue(unsafe.Pointer(&stackId))
+	if err != nil {
+		return nil
+	}
+	var stack []uint64
+	for i := 0; i+8 <= len(rawStack); i += 8 {
+		addr := binary.LittleEndian.Uint64(rawStack[i : i+8])
+		if addr == 0 {
+			break
+		}
+		stack = append(stack, addr)
+	}
+	return stack
+}
+
+func printStack(key HistKey, stackmap *bpf.BPFMap, symsCache *common.SymsCache) {
+	stack := getStack(stackmap, key.UserStackId)
+	if stack == nil {
+		fmt.Printf("    [Missed User Stack]\n")
+		return
+	}
+	syms, err := symsCache.GetSyms(int(key.Pid))
+	for _, addr := range stack {
+		name := "[unknown]"
+		if err == nil {
+			if s, dso, offset := syms.MapAddrDso(addr); s != nil {
+				name = fmt.Sprintf("%s+%#x", s.Name, s.Offset)
+			} else if dso != "" {
+				name = fmt.Sprintf("[%s+%#x]", dso, offset)
+			}
+		}
+		fmt.Printf("    %#x %s\n", addr, name)
+	}
+}
+
+func printHists(hists, stackmap *bpf.BPFMap, symsCache *common.SymsCache) {
+	units := "usecs"
+	if opts.milliseconds {
+		units = "msecs"
+	}
+	items, err := common.DumpThenClearHash(hists)
+	if err != nil {
+		log.Fatalf("failed to dump hists: %s", err)
+	}
+	var contentions []Contention
+	for _, item := range items {
+		var c Contention
+		if err := binary.Read(bytes.NewReader(item[0]), binary.LittleEndian, &c.Key); err != nil {
+			log.Fatalln(err)
+		}
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &c.Hist); err != nil {
+			log.Fatalln(err)
+		}
+		contentions = append(contentions, c)
+	}
+	sort.Slice(contentions, func(i, j int) bool {
+		return contentions[i].Hist.TotalElapsed > contentions[j].Hist.TotalElapsed
+	})
+
+	for _, c := range contentions {
+		h := c.Hist
+		/* the entry may be created but not counted yet */
+		if h.Contended == 0 {
+			continue
+		}
+		fmt.Printf("%s[%d] lock %#x contended %d times, %d avg %s [max: %d, min: %d]\n",
+			common.GoString(h.Comm[:]), c.Key.Pid, c.Key.Uaddr, h.Contended,
+			toUnits(h.TotalElapsed/h.Contended), units, toUnits(h.Max), toUnits(h.Min))
+		printStack(c.Key, stackmap, symsCache)
+
+		var vals []int
+		for _, v := range h.Slots {
+			vals = append(vals, int(v))
+		}
+		common.PrintLog2Hist(vals, units)
+		fmt.Printf("\n")
+	}
+}
+
+func toUnits(ns uint64) uint64 {
+	if opts.milliseconds {
+		return ns / 1000000
+	}
+	return ns / 1000
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	hists, err := bpfModule.GetMap("hists")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	times := opts.times
+	fmt.Printf("Summarize futex contention latency... Hit Ctrl-C to end.\n")
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		fmt.Printf("\n")
+		if opts.timestamp {
+			ts := time.Now().Format("15:04:05")
+			fmt.Printf("%-8s\n", ts)
+		}
+		/* reload the maps of the processes, as they may have loaded new libraries or be reused */
+		printHists(hists, stackmap, common.NewSymsCache())
+
+		times--
+		if end || times == 0 {
+			break loop
+		}
+	}
+}
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/gethostlatency.bpf.c
\ No newline at end of file
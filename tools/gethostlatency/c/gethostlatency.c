@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/gethostlatency.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/gethostlatency.h
\ No newline at end of file
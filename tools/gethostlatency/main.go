@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/aquasecurity/libbpfgo/helpers"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN = 16
+	HOST_LEN      = 80
+)
+
+type Event struct {
+	Time uint64
+	Pid  uint32
+	Comm [TASK_COMM_LEN]byte
+	Host [HOST_LEN]byte
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	libc       string
+}
+
+var opts = Options{
+	bpfObjPath: "gethostlatency.bpf.o",
+	verbose:    false,
+	pid:        0,
+	libc:       "",
+}
+
+var resolverFuncs = []string{"getaddrinfo", "gethostbyname", "gethostbyname2"}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Process ID to trace")
+	flag.StringVarP(&opts.libc, "libc", "l", opts.libc, "Specify which libc.so to use")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("target_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	libcPath := opts.libc
+	if libcPath == "" {
+		var err error
+		libcPath, err = common.GetPidLibPath(int(opts.pid), "c")
+		if err != nil {
+			log.Fatalf("could not find libc.so: %s", err)
+		}
+	}
+	pid := -1
+	if opts.pid > 0 {
+		pid = int(opts.pid)
+	}
+
+	entryProg, err := bpfModule.GetProgram("handle_entry")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	returnProg, err := bpfModule.GetProgram("handle_return")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, name := range resolverFuncs {
+		funcOff, err := helpers.SymbolToOffset(libcPath, name)
+		if err != nil || funcOff <= 0 {
+			log.Fatalf("could not find %s in %s\n", name, libcPath)
+		}
+		if _, err := entryProg.AttachUprobe(pid, libcPath, funcOff); err != nil {
+			log.Fatalf("failed to attach %s: %s", name, err)
+		}
+		if _, err := returnProg.AttachURetprobe(pid, libcPath, funcOff); err != nil {
+			log.Fatalf("failed to attach %s: %s", name, err)
+		}
+	}
+}
+
+func printEvent(data []byte) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("%-8s %-7d %-16s %-10.3f %-s\n",
+		ts, e.Pid, common.GoString(e.Comm[:]), float64(e.Time)/1000000, common.GoString(e.Host[:]))
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	fmt.Printf("%-8s %-7s %-16s %-10s %-s\n", "TIME", "PID", "COMM", "LATms", "HOST")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const MAX_SLOTS = 20
+
+type IrqKey struct {
+	Name [32]byte
+	Cpu  uint32
+}
+
+type Info struct {
+	Count uint64
+	Slots [MAX_SLOTS]uint32
+}
+
+type IrqStat struct {
+	Key   IrqKey
+	Value Info
+}
+
+type Options struct {
+	bpfObjPath  string
+	verbose     bool
+	count       bool
+	distributed bool
+	nanoseconds bool
+	perCpu      bool
+	cpu         int32
+	timestamp   bool
+	cgroup      string
+	interval    uint64
+	times       uint64
+}
+
+var opts = Options{
+	bpfObjPath:  "hardirqs.bpf.o",
+	verbose:     false,
+	count:       false,
+	distributed: false,
+	nanoseconds: false,
+	perCpu:      false,
+	cpu:         -1,
+	timestamp:   false,
+	cgroup:      "",
+	interval:    99999999,
+	times:       99999999,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.count, "count", "C", opts.count, "Show event counts instead of timing")
+	flag.BoolVarP(&opts.distributed, "distributed", "d", opts.distributed, "Show distributions as histograms")
+	flag.StringVarP(&opts.cgroup, "cgroup", "c", opts.cgroup, "Trace process in cgroup path")
+	flag.Int32VarP(&opts.cpu, "cpu", "s", opts.cpu, "Trace this cpu only")
+	flag.BoolVarP(&opts.perCpu, "per-cpu", "P", opts.perCpu, "Show a breakdown per CPU")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Include timestamp on output")
+	flag.BoolVarP(&opts.nanoseconds, "nanoseconds", "N", opts.nanoseconds, "Output in nanoseconds")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.count && opts.distributed {
+		log.Fatalln("count, distributed cann't be used together")
+	}
+	if opts.cpu >= 0 {
+		cpus, err := bpf.NumPossibleCPUs()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if int(opts.cpu) >= cpus {
+			log.Fatalf("Invalid cpu: %d\n", opts.cpu)
+		}
+	}
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			times, err := strconv.Atoi(args[1])
+			if err != nil || times <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.times = uint64(times)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.cgroup != "" {
+		if err := bpfModule.InitGlobalVariable("filter_cg", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.count {
+		if err := bpfModule.InitGlobalVariable("do_count", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.distributed {
+		if err := bpfModule.InitGlobalVariable("targ_dist", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.nanoseconds {
+		if err := bpfModule.InitGlobalVariable("targ_ns", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.perCpu {
+		if err := bpfModule.InitGlobalVariable("targ_per_cpu", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.cpu >= 0 {
+		if err := bpfModule.InitGlobalVariable("targ_cpu", opts.cpu); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) []string {
+	names := []string{"irq_handler_entry", "irq_handler_exit"}
+	disabled := []string{"irq_handler_entry_btf", "irq_handler_exit_btf"}
+	if common.VmlinuxBTFExists() {
+		names, disabled = disabled, names
+	}
+	for _, name := range disabled {
+		prog, err := bpfModule.GetProgram(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return names
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+	if opts.cgroup != "" {
+		idx := 0
+		cgroupFd, err := common.GetCgroupDirFD(opts.cgroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cgroupMap, err := bpfModule.GetMap("cgroup_map")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := cgroupMap.Update(unsafe.Pointer(&idx), unsafe.Pointer(&cgroupFd)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module, names []string) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if !common.Contains(names, prog.Name()) {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func printMap(infos *bpf.BPFMap) {
+	units := "usecs"
+	if opts.nanoseconds {
+		units = "nsecs"
+	}
+	items, err := common.DumpThenClearHash(infos)
+	if err != nil {
+		log.Fatalf("failed to dump infos: %s", err)
+	}
+	var stats []IrqStat
+	for _, item := range items {
+		var stat IrqStat
+		if err := binary.Read(bytes.NewReader(item[0]), binary.LittleEndian, &stat.Key); err != nil {
+			log.Fatalln(err)
+		}
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &stat.Value); err != nil {
+			log.Fatalln(err)
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Key.Cpu != stats[j].Key.Cpu {
+			return stats[i].Key.Cpu < stats[j].Key.Cpu
+		}
+		return stats[i].Value.Count > stats[j].Value.Count
+	})
+
+	if !opts.distributed {
+		column := "TOTAL_" + units
+		if opts.count {
+			column = "TOTAL_count"
+		}
+		if opts.perCpu {
+			fmt.Printf("%-4s ", "CPU")
+		}
+		fmt.Printf("%-26s %11s\n", "HARDIRQ", column)
+	}
+	for _, stat := range stats {
+		name := common.GoString(stat.Key.Name[:])
+		if !opts.distributed {
+			if opts.perCpu {
+				fmt.Printf("%-4d ", stat.Key.Cpu)
+			}
+			fmt.Printf("%-26s %11d\n", name, stat.Value.Count)
+			continue
+		}
+
+		if opts.perCpu {
+			fmt.Printf("hardirq = %s, cpu = %d\n", name, stat.Key.Cpu)
+		} else {
+			fmt.Printf("hardirq = %s\n", name)
+		}
+		var vals []int
+		for _, v := range stat.Value.Slots {
+			vals = append(vals, int(v))
+		}
+		common.PrintLog2Hist(vals, units)
+	}
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	names := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, names)
+
+	infos, err := bpfModule.GetMap("infos")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	times := opts.times
+	if opts.count {
+		fmt.Printf("Tracing hard irq events... Hit Ctrl-C to end.\n")
+	} else {
+		fmt.Printf("Tracing hard irq event time... Hit Ctrl-C to end.\n")
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		fmt.Printf("\n")
+		if opts.timestamp {
+			ts := time.Now().Format("15:04:05")
+			fmt.Printf("%-8s\n", ts)
+		}
+		printMap(infos)
+
+		times--
+		if end || times == 0 {
+			break loop
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const USDT_PROVIDER = "hotspot"
+
+type Data struct {
+	Cpu uint32
+	Pid uint32
+	Ts  uint64
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	time       uint64
+}
+
+var opts = Options{
+	bpfObjPath: "javagc.bpf.o",
+	verbose:    false,
+	pid:        -1,
+	time:       1000,
+}
+
+// probes maps the hotspot USDT probes to the programs attached to them.
+var probes = []struct {
+	name string
+	prog string
+}{
+	{"mem__pool__gc__begin", "handle_mem_pool_gc_start"},
+	{"mem__pool__gc__end", "handle_mem_pool_gc_end"},
+	{"gc__begin", "handle_gc_start"},
+	{"gc__end", "handle_gc_end"},
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Trace this PID only")
+	flag.Uint64VarP(&opts.time, "time", "t", opts.time, "Java gc time threshold in usecs")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.pid <= 0 {
+		log.Fatalln("a pid must be specified with -p")
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if err := bpfModule.InitGlobalVariable("time", opts.time*1000); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+// attachPrograms attaches the programs to the hotspot USDT probes in libjvm
+// and enables their semaphores. The returned notes must be disabled on exit,
+// on error the notes already enabled are disabled before returning.
+func attachPrograms(bpfModule *bpf.Module) ([]*common.USDTNote, error) {
+	binaryPath, err := common.GetPidLibPath(int(opts.pid), "jvm")
+	if err != nil {
+		return nil, fmt.Errorf("could not find libjvm.so: %w", err)
+	}
+
+	var notes []*common.USDTNote
+	for _, probe := range probes {
+		note, err := common.FindUSDTNote(binaryPath, USDT_PROVIDER, probe.name)
+		if err != nil {
+			disableSemaphores(notes)
+			return nil, err
+		}
+		prog, err := bpfModule.GetProgram(probe.prog)
+		if err != nil {
+			disableSemaphores(notes)
+			return nil, err
+		}
+		if _, err := prog.AttachUprobe(int(opts.pid), binaryPath, uint32(note.FileOffset)); err != nil {
+			disableSemaphores(notes)
+			return nil, fmt.Errorf("failed to attach %s: %w", note, err)
+		}
+		if err := note.EnableSemaphore(int(opts.pid)); err != nil {
+			disableSemaphores(notes)
+			return nil, fmt.Errorf("failed to enable %s: %w", note, err)
+		}
+		notes = append(notes, note)
+	}
+	return notes, nil
+}
+
+func disableSemaphores(notes []*common.USDTNote) {
+	for _, note := range notes {
+		if err := note.DisableSemaphore(int(opts.pid)); err != nil {
+			log.Printf("failed to disable %s: %s", note, err)
+		}
+	}
+}
+
+func printEvent(data []byte) {
+	var e Data
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("%-8s %-7d %-7d %-7d\n", ts, e.Cpu, e.Pid, e.Ts/1000)
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	notes, err := attachPrograms(bpfModule)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer disableSemaphores(notes)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("perf_map", eventsChannel, lostChannel, 1)
+	if err != nil {
+		/* log.Fatalln skips the deferred calls */
+		disableSemaphores(notes)
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	fmt.Printf("Tracing javagc time... Hit Ctrl-C to end.\n")
+	fmt.Printf("%-8s %-7s %-7s %-7s\n", "TIME", "CPU", "PID", "GC TIME")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/klockstat.bpf.c
\ No newline at end of file
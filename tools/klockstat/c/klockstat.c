@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/klockstat.c
\ No newline at end of file
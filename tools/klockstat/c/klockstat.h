@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/klockstat.h
\ No newline at end of file
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN        = 16
+	PERF_MAX_STACK_DEPTH = 127
+)
+
+type LockStat struct {
+	AcqCount      uint64
+	AcqTotalTime  uint64
+	AcqMaxTime    uint64
+	AcqMaxId      uint64
+	AcqMaxLockPtr uint64
+	AcqMaxComm    [TASK_COMM_LEN]byte
+	HldCount      uint64
+	HldTotalTime  uint64
+	HldMaxTime    uint64
+	HldMaxId      uint64
+	HldMaxLockPtr uint64
+	HldMaxComm    [TASK_COMM_LEN]byte
+}
+
+type StackStat struct {
+	StackId uint32
+	Stat    LockStat
+	Stack   []uint64
+}
+
+const (
+	SORT_ACQ_MAX = iota
+	SORT_ACQ_COUNT
+	SORT_ACQ_TOTAL
+	SORT_HLD_MAX
+	SORT_HLD_COUNT
+	SORT_HLD_TOTAL
+)
+
+var sortNames = map[string]int{
+	"acq_max":   SORT_ACQ_MAX,
+	"acq_count": SORT_ACQ_COUNT,
+	"acq_total": SORT_ACQ_TOTAL,
+	"hld_max":   SORT_HLD_MAX,
+	"hld_count": SORT_HLD_COUNT,
+	"hld_total": SORT_HLD_TOTAL,
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	tid        int32
+	caller     string
+	lock       string
+	nrLocks    uint
+	nrStacks   uint
+	sort       string
+	duration   uint
+	interval   uint
+	reset      bool
+	timestamp  bool
+	sortAcq    int
+	sortHld    int
+}
+
+var opts = Options{
+	bpfObjPath: "klockstat.bpf.o",
+	verbose:    false,
+	pid:        0,
+	tid:        0,
+	caller:     "",
+	lock:       "",
+	nrLocks:    99999999,
+	nrStacks:   1,
+	sort:       "",
+	duration:   0,
+	interval:   0,
+	reset:      false,
+	timestamp:  false,
+	sortAcq:    SORT_ACQ_MAX,
+	sortHld:    SORT_HLD_MAX,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Filter by process ID")
+	flag.Int32VarP(&opts.tid, "tid", "t", opts.tid, "Filter by thread ID")
+	flag.StringVarP(&opts.caller, "caller", "c", opts.caller, "Filter by caller string prefix")
+	flag.StringVarP(&opts.lock, "lock", "L", opts.lock, "Filter by specific ksym lock name")
+	flag.UintVarP(&opts.nrLocks, "locks", "n", opts.nrLocks, "Number of locks or threads to print")
+	flag.UintVarP(&opts.nrStacks, "stacks", "s", opts.nrStacks, "Number of stack entries to print per lock")
+	flag.StringVarP(&opts.sort, "sort", "S", opts.sort,
+		"Sort by field:\n  acq_[max|total|count]\n  hld_[max|total|count]")
+	flag.UintVarP(&opts.duration, "duration", "d", opts.duration, "Duration to trace")
+	flag.UintVarP(&opts.interval, "interval", "i", opts.interval, "Print interval")
+	flag.BoolVarP(&opts.reset, "reset", "R", opts.reset, "Reset stats each interval")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Print timestamp")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.nrStacks < 1 || opts.nrStacks > PERF_MAX_STACK_DEPTH {
+		log.Fatalf("Invalid number of stack entries: %d\n", opts.nrStacks)
+	}
+	if opts.sort != "" {
+		for _, name := range strings.Split(opts.sort, ",") {
+			s, ok := sortNames[name]
+			if !ok {
+				log.Fatalf("Bad sort string: %s\n", name)
+			}
+			if strings.HasPrefix(name, "acq_") {
+				opts.sortAcq = s
+			} else {
+				opts.sortHld = s
+			}
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module, ksyms *common.Ksyms) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_tgid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.tid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.tid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.lock != "" {
+		ksym := ksyms.GetSymbol(opts.lock)
+		if ksym == nil {
+			log.Fatalf("failed to find lock %s\n", opts.lock)
+		}
+		if err := bpfModule.InitGlobalVariable("targ_lock", ksym.Addr); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// setAutoload keeps the fentry/fexit programs when the kernel supports them,
+// and the kprobe ones otherwise. Programs whose lock functions don't exist on
+// this kernel (e.g. down_read_interruptible) are not loaded.
+func setAutoload(bpfModule *bpf.Module) []string {
+	useFentry := common.FentryCanAttach("mutex_lock")
+	var names []string
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		isKprobe := prog.GetType() == bpf.BPFProgTypeKprobe
+		section := prog.SectionName()
+		target := section[strings.Index(section, "/")+1:]
+		if isKprobe != useFentry && common.KprobeExists(target) {
+			names = append(names, prog.Name())
+			continue
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return names
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module, names []string) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if !common.Contains(names, prog.Name()) {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func formatTime(nsec uint64) string {
+	table := []struct {
+		base float64
+		unit string
+	}{
+		{1e9 * 3600, "h "},
+		{1e9 * 60, "m "},
+		{1e9, "s "},
+		{1e6, "ms"},
+		{1e3, "us"},
+	}
+	for _, t := range table {
+		if float64(nsec) < t.base {
+			continue
+		}
+		return fmt.Sprintf("%.1f %s", float64(nsec)/t.base, t.unit)
+	}
+	return fmt.Sprintf("%d ns", nsec)
+}
+
+func formatKsym(ksyms *common.Ksyms, addr uint64) string {
+	if ksym := ksyms.MapAddr(addr); ksym != nil {
+		return fmt.Sprintf("%s+0x%x", ksym.Name, addr-ksym.Addr)
+	}
+	return fmt.Sprintf("0x%x", addr)
+}
+
+// lockName only names locks which are global symbols, as the addresses of
+// locks embedded in dynamically allocated objects don't belong to any symbol.
+func lockName(ksyms *common.Ksyms, lockPtr uint64) string {
+	if ksym := ksyms.MapAddr(lockPtr); ksym != nil && ksym.Addr == lockPtr {
+		return fmt.Sprintf("%s (0x%x)", ksym.Name, lockPtr)
+	}
+	return fmt.Sprintf("0x%x", lockPtr)
+}
+
+func callerIsTraced(ksyms *common.Ksyms, callerPc uint64) bool {
+	if opts.caller == "" {
+		return true
+	}
+	ksym := ksyms.MapAddr(callerPc)
+	if ksym == nil {
+		return true
+	}
+	return strings.HasPrefix(ksym.Name, opts.caller)
+}
+
+func getStack(stackMap *bpf.BPFMap, stackId uint32) []uint64 {
+	rawStack, err := stackMap.GetValue(unsafe.Pointer(&stackId))
+	if err != nil {
+		return nil
+	}
+	var stack []uint64
+	for i := 0; i+8 <= len(rawStack); i += 8 {
+		addr := binary.LittleEndian.Uint64(rawStack[i : i+8])
+		if addr == 0 {
+			break
+		}
+		stack = append(stack, addr)
+	}
+	return stack
+}
+
+func readStats(statMap, stackMap *bpf.BPFMap, ksyms *common.Ksyms) []StackStat {
+	var items [][2][]byte
+	var err error
+	if opts.reset {
+		items, err = common.DumpThenClearHash(statMap)
+	} else {
+		items, err = common.DumpHash(statMap)
+	}
+	if err != nil {
+		log.Fatalf("failed to dump stat_map: %s", err)
+	}
+	var stats []StackStat
+	for _, item := range items {
+		var ss StackStat
+		ss.StackId = binary.LittleEndian.Uint32(item[0])
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &ss.Stat); err != nil {
+			log.Fatalln(err)
+		}
+		ss.Stack = getStack(stackMap, ss.StackId)
+		if len(ss.Stack) == 0 || !callerIsTraced(ksyms, ss.Stack[0]) {
+			continue
+		}
+		stats = append(stats, ss)
+	}
+	return stats
+}
+
+func sortKey(stat LockStat, by int) uint64 {
+	switch by {
+	case SORT_ACQ_COUNT:
+		return stat.AcqCount
+	case SORT_ACQ_TOTAL:
+		return stat.AcqTotalTime
+	case SORT_HLD_MAX:
+		return stat.HldMaxTime
+	case SORT_HLD_COUNT:
+		return stat.HldCount
+	case SORT_HLD_TOTAL:
+		return stat.HldTotalTime
+	default:
+		return stat.AcqMaxTime
+	}
+}
+
+func printStackStat(ksyms *common.Ksyms, ss StackStat, count, maxTime, totalTime, maxId, lockPtr uint64,
+	comm []byte) {
+	var avg uint64
+	if count > 0 {
+		avg = totalTime / count
+	}
+	fmt.Printf("%37s %9s %8d %10s %12s\n", formatKsym(ksyms, ss.Stack[0]),
+		formatTime(avg), count, formatTime(maxTime), formatTime(totalTime))
+	for i := 1; i < len(ss.Stack) && i < int(opts.nrStacks); i++ {
+		fmt.Printf("%37s\n", formatKsym(ksyms, ss.Stack[i]))
+	}
+	fmt.Printf("%37s Max PID %d, COMM %s, Lock %s\n", "",
+		maxId>>32, common.GoString(comm), lockName(ksyms, lockPtr))
+}
+
+// topStats returns the first opts.nrLocks stats sorted by the sort key by,
+// leaving out the ones which are not counted, so that they don't use up rows.
+func topStats(stats []StackStat, by int, count func(LockStat) uint64) []StackStat {
+	var ret []StackStat
+	for _, ss := range stats {
+		if count(ss.Stat) > 0 {
+			ret = append(ret, ss)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return sortKey(ret[i].Stat, by) > sortKey(ret[j].Stat, by)
+	})
+	if len(ret) > int(opts.nrLocks) {
+		ret = ret[:opts.nrLocks]
+	}
+	return ret
+}
+
+func printStats(statMap, stackMap *bpf.BPFMap, ksyms *common.Ksyms) {
+	stats := readStats(statMap, stackMap, ksyms)
+
+	if opts.timestamp {
+		ts := time.Now().Format("15:04:05")
+		fmt.Printf("\n%-8s\n", ts)
+	}
+
+	fmt.Printf("\n%37s %9s %8s %10s %12s\n", "Caller", "Avg Wait", "Count", "Max Wait", "Total Wait")
+	for _, ss := range topStats(stats, opts.sortAcq, func(s LockStat) uint64 { return s.AcqCount }) {
+		s := ss.Stat
+		printStackStat(ksyms, ss, s.AcqCount, s.AcqMaxTime, s.AcqTotalTime, s.AcqMaxId, s.AcqMaxLockPtr,
+			s.AcqMaxComm[:])
+	}
+
+	fmt.Printf("\n%37s %9s %8s %10s %12s\n", "Caller", "Avg Hold", "Count", "Max Hold", "Total Hold")
+	for _, ss := range topStats(stats, opts.sortHld, func(s LockStat) uint64 { return s.HldCount }) {
+		s := ss.Stat
+		printStackStat(ksyms, ss, s.HldCount, s.HldMaxTime, s.HldTotalTime, s.HldMaxId, s.HldMaxLockPtr,
+			s.HldMaxComm[:])
+	}
+}
+
+func main() {
+	parseArgs()
+
+	ksyms, err := common.LoadKsyms()
+	if err != nil {
+		log.Fatalf("failed to load kallsyms: %s", err)
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule, ksyms)
+	names := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, names)
+
+	statMap, err := bpfModule.GetMap("stat_map")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	stackMap, err := bpfModule.GetMap("stack_map")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var intervalC <-chan time.Time
+	if opts.interval > 0 {
+		ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+		defer ticker.Stop()
+		intervalC = ticker.C
+	}
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(opts.duration))
+		defer cancel()
+	}
+	var done bool
+
+	fmt.Printf("Tracing mutex/sem lock events...  Hit Ctrl-C to end\n")
+
+loop:
+	for {
+		select {
+		case <-intervalC:
+		case <-ctx.Done():
+			done = true
+		}
+
+		printStats(statMap, stackMap, ksyms)
+
+		if done {
+			break loop
+		}
+	}
+	fmt.Printf("Exiting trace of mutex/sem locks\n")
+}
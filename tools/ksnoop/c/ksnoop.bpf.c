@@ -0,0 +1,284 @@
+// SPDX-License-Identifier: GPL-2.0
+/*
+ * Inspired by ksnoop.bpf.c from bcc/libbpf-tools. Userspace resolves the
+ * traced values with BTF and stores, for every traced function, which
+ * argument to read, at which offset and how many bytes in the traces map.
+ */
+#include <vmlinux.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "ksnoop.h"
+
+#if defined(__TARGET_ARCH_x86)
+#define KSNOOP_IP_FIX(ip)	((ip) - sizeof(kprobe_opcode_t))
+#else
+#define KSNOOP_IP_FIX(ip)	(ip)
+#endif
+
+const volatile pid_t targ_tgid = 0;
+const volatile bool stack_mode = false;
+
+struct func_stack {
+	__u64 ips[FUNC_MAX_STACK_DEPTH];
+	__u8 matched[FUNC_MAX_STACK_DEPTH];
+	__u32 depth;
+};
+
+static struct func_stack zero_stack;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_FUNC_TRACES);
+	__type(key, __u64);
+	__type(value, struct trace_config);
+} traces SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 10240);
+	__type(key, __u32);
+	__type(value, struct func_stack);
+} func_stacks SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, struct event);
+} scratch SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(__u32));
+	__uint(value_size, sizeof(__u32));
+} events SEC(".maps");
+
+static __always_inline __u64 func_ip(struct pt_regs *ctx)
+{
+	if (bpf_core_enum_value_exists(enum bpf_func_id, BPF_FUNC_get_func_ip))
+		return bpf_get_func_ip(ctx);
+	return KSNOOP_IP_FIX(PT_REGS_IP(ctx));
+}
+
+static __always_inline __u64 get_arg(struct pt_regs *ctx, __u32 arg)
+{
+	switch (arg) {
+	case KSNOOP_ARG1:
+		return PT_REGS_PARM1(ctx);
+	case KSNOOP_ARG2:
+		return PT_REGS_PARM2(ctx);
+	case KSNOOP_ARG3:
+		return PT_REGS_PARM3(ctx);
+	case KSNOOP_ARG4:
+		return PT_REGS_PARM4(ctx);
+	case KSNOOP_ARG5:
+		return PT_REGS_PARM5(ctx);
+	case KSNOOP_RETURN:
+		return PT_REGS_RC(ctx);
+	}
+	return 0;
+}
+
+static __always_inline bool check_predicate(struct trace_value *v, __u8 *buf)
+{
+	__u64 val = 0;
+	__s64 sval = 0;
+	bool is_signed = v->flags & KSNOOP_F_SIGNED;
+
+	switch (v->size) {
+	case 1:
+		val = *(__u8 *)buf;
+		sval = *(__s8 *)buf;
+		break;
+	case 2:
+		val = *(__u16 *)buf;
+		sval = *(__s16 *)buf;
+		break;
+	case 4:
+		val = *(__u32 *)buf;
+		sval = *(__s32 *)buf;
+		break;
+	default:
+		val = *(__u64 *)buf;
+		sval = *(__s64 *)buf;
+		break;
+	}
+
+	switch (v->flags & KSNOOP_F_PREDICATE_MASK) {
+	case KSNOOP_F_PREDICATE_EQ:
+		return val == v->predicate_value;
+	case KSNOOP_F_PREDICATE_NOTEQ:
+		return val != v->predicate_value;
+	case KSNOOP_F_PREDICATE_GT:
+		return is_signed ? sval > (__s64)v->predicate_value : val > v->predicate_value;
+	case KSNOOP_F_PREDICATE_LT:
+		return is_signed ? sval < (__s64)v->predicate_value : val < v->predicate_value;
+	}
+	return true;
+}
+
+/*
+ * Read the values of the entry (arguments) or of the return of a function
+ * into the scratch event, returning false if a predicate doesn't match.
+ */
+static __always_inline bool collect_values(struct pt_regs *ctx, struct trace_config *config,
+					   struct event *e, bool ret)
+{
+	int i;
+
+	e->nr_values = config->nr_values;
+#pragma unroll
+	for (i = 0; i < MAX_TRACES; i++) {
+		struct trace_value *v = &config->values[i];
+		__u32 size = v->size;
+		__u64 base;
+
+		if (i >= config->nr_values)
+			break;
+		e->sizes[i] = 0;
+		if ((v->base_arg == KSNOOP_RETURN) != ret)
+			continue;
+
+		base = get_arg(ctx, v->base_arg);
+		if (v->flags & KSNOOP_F_PTR) {
+			if (size > MAX_VALUE_SIZE)
+				size = MAX_VALUE_SIZE;
+			if (bpf_probe_read_kernel(e->values[i], size, (void *)(base + v->offset)))
+				size = 0;
+		} else {
+			*(__u64 *)e->values[i] = base;
+			size = sizeof(base);
+		}
+		e->sizes[i] = size;
+
+		if (v->flags & KSNOOP_F_PREDICATE_MASK) {
+			if (!size || !check_predicate(v, e->values[i]))
+				return false;
+		}
+	}
+	return true;
+}
+
+static __always_inline void output_event(struct pt_regs *ctx, struct event *e, __u64 ip,
+					 __u32 flags, __u32 depth)
+{
+	__u64 pid_tgid = bpf_get_current_pid_tgid();
+
+	e->ts = bpf_ktime_get_ns();
+	e->ip = ip;
+	e->pid = pid_tgid >> 32;
+	e->tid = (__u32)pid_tgid;
+	e->cpu = bpf_get_smp_processor_id();
+	e->flags = flags;
+	e->stack_depth = depth;
+	bpf_get_current_comm(&e->comm, sizeof(e->comm));
+	bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+}
+
+static __always_inline bool parent_matched(struct func_stack *stack, __u64 parent_ip)
+{
+	int i;
+
+#pragma unroll
+	for (i = 0; i < FUNC_MAX_STACK_DEPTH; i++) {
+		if (i >= stack->depth)
+			break;
+		if (stack->ips[i] == parent_ip && stack->matched[i])
+			return true;
+	}
+	return false;
+}
+
+SEC("kprobe/ksnoop_entry")
+int BPF_KPROBE(kprobe_entry)
+{
+	__u64 pid_tgid = bpf_get_current_pid_tgid();
+	__u32 tid = (__u32)pid_tgid;
+	struct trace_config *config;
+	struct func_stack *stack;
+	struct event *e;
+	__u32 zero = 0, depth;
+	__u64 ip;
+	bool matched;
+
+	if (targ_tgid && targ_tgid != pid_tgid >> 32)
+		return 0;
+
+	stack = bpf_map_lookup_elem(&func_stacks, &tid);
+	if (!stack) {
+		bpf_map_update_elem(&func_stacks, &tid, &zero_stack, BPF_NOEXIST);
+		stack = bpf_map_lookup_elem(&func_stacks, &tid);
+		if (!stack)
+			return 0;
+	}
+	/*
+	 * Every entry is pushed, even if it is not reported, so that the
+	 * return probe always pops its own function.
+	 */
+	depth = stack->depth;
+	if (depth >= FUNC_MAX_STACK_DEPTH) {
+		stack->depth = depth + 1;
+		return 0;
+	}
+
+	e = bpf_map_lookup_elem(&scratch, &zero);
+	if (!e)
+		return 0;
+
+	ip = func_ip(ctx);
+	config = bpf_map_lookup_elem(&traces, &ip);
+	matched = config != NULL;
+	if (matched && stack_mode && config->parent_ip)
+		matched = parent_matched(stack, config->parent_ip);
+	if (matched)
+		matched = collect_values(ctx, config, e, false);
+
+	stack->ips[depth] = ip;
+	stack->matched[depth] = matched;
+	stack->depth = depth + 1;
+
+	if (matched && config && (config->flags & KSNOOP_F_ENTRY))
+		output_event(ctx, e, ip, KSNOOP_F_ENTRY, depth);
+	return 0;
+}
+
+SEC("kretprobe/ksnoop_return")
+int BPF_KRETPROBE(kretprobe_return)
+{
+	__u64 pid_tgid = bpf_get_current_pid_tgid();
+	__u32 tid = (__u32)pid_tgid;
+	struct trace_config *config;
+	struct func_stack *stack;
+	struct event *e;
+	__u32 zero = 0, depth;
+	__u64 ip;
+
+	if (targ_tgid && targ_tgid != pid_tgid >> 32)
+		return 0;
+
+	stack = bpf_map_lookup_elem(&func_stacks, &tid);
+	if (!stack || stack->depth == 0)
+		return 0;
+	depth = --stack->depth;
+	if (depth >= FUNC_MAX_STACK_DEPTH)
+		return 0;
+	ip = stack->ips[depth];
+	if (!stack->matched[depth])
+		return 0;
+
+	config = bpf_map_lookup_elem(&traces, &ip);
+	if (!config || !(config->flags & KSNOOP_F_RETURN))
+		return 0;
+
+	e = bpf_map_lookup_elem(&scratch, &zero);
+	if (!e)
+		return 0;
+	if (!collect_values(ctx, config, e, true))
+		return 0;
+
+	output_event(ctx, e, ip, KSNOOP_F_RETURN, depth);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __KSNOOP_H
+#define __KSNOOP_H
+
+#define TASK_COMM_LEN		16
+#define MAX_FUNC_TRACES		64
+#define MAX_TRACES		8
+#define MAX_VALUE_SIZE		256
+#define FUNC_MAX_STACK_DEPTH	16
+
+enum arg {
+	KSNOOP_ARG1,
+	KSNOOP_ARG2,
+	KSNOOP_ARG3,
+	KSNOOP_ARG4,
+	KSNOOP_ARG5,
+	KSNOOP_RETURN,
+};
+
+/* flags of struct trace_config and struct event */
+#define KSNOOP_F_ENTRY			0x1
+#define KSNOOP_F_RETURN			0x2
+
+/* flags of struct trace_value */
+#define KSNOOP_F_PTR			0x1	/* value is read from arg + offset */
+#define KSNOOP_F_SIGNED			0x2
+#define KSNOOP_F_PREDICATE_EQ		0x10
+#define KSNOOP_F_PREDICATE_NOTEQ	0x20
+#define KSNOOP_F_PREDICATE_GT		0x40
+#define KSNOOP_F_PREDICATE_LT		0x80
+#define KSNOOP_F_PREDICATE_MASK		0xf0
+
+struct trace_value {
+	__u32 base_arg;
+	__u32 flags;
+	__u32 offset;
+	__u32 size;
+	__u64 predicate_value;
+};
+
+struct trace_config {
+	/* in stack mode, the function has to be called by this one */
+	__u64 parent_ip;
+	__u32 flags;
+	__u32 nr_values;
+	struct trace_value values[MAX_TRACES];
+};
+
+struct event {
+	__u64 ts;
+	__u64 ip;
+	__u32 pid;
+	__u32 tid;
+	__u32 cpu;
+	__u32 flags;
+	__u32 stack_depth;
+	__u32 nr_values;
+	__u32 sizes[MAX_TRACES];
+	char comm[TASK_COMM_LEN];
+	__u8 values[MAX_TRACES][MAX_VALUE_SIZE];
+};
+
+#endif /* __KSNOOP_H */
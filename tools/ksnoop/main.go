@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN        = 16
+	MAX_FUNC_TRACES      = 64
+	MAX_TRACES           = 8
+	MAX_VALUE_SIZE       = 256
+	MAX_ARGS             = 5
+	FUNC_MAX_STACK_DEPTH = 16
+)
+
+const (
+	KSNOOP_ARG1 = iota
+	KSNOOP_ARG2
+	KSNOOP_ARG3
+	KSNOOP_ARG4
+	KSNOOP_ARG5
+	KSNOOP_RETURN
+)
+
+const (
+	KSNOOP_F_ENTRY  = 0x1
+	KSNOOP_F_RETURN = 0x2
+)
+
+const (
+	KSNOOP_F_PTR             = 0x1
+	KSNOOP_F_SIGNED          = 0x2
+	KSNOOP_F_PREDICATE_EQ    = 0x10
+	KSNOOP_F_PREDICATE_NOTEQ = 0x20
+	KSNOOP_F_PREDICATE_GT    = 0x40
+	KSNOOP_F_PREDICATE_LT    = 0x80
+)
+
+var predicateFlags = map[string]uint32{
+	"==": KSNOOP_F_PREDICATE_EQ,
+	"!=": KSNOOP_F_PREDICATE_NOTEQ,
+	">":  KSNOOP_F_PREDICATE_GT,
+	"<":  KSNOOP_F_PREDICATE_LT,
+}
+
+type TraceValue struct {
+	BaseArg        uint32
+	Flags          uint32
+	Offset         uint32
+	Size           uint32
+	PredicateValue uint64
+}
+
+type TraceConfig struct {
+	ParentIp uint64
+	Flags    uint32
+	NrValues uint32
+	Values   [MAX_TRACES]TraceValue
+}
+
+type Event struct {
+	Ts         uint64
+	Ip         uint64
+	Pid        uint32
+	Tid        uint32
+	Cpu        uint32
+	Flags      uint32
+	StackDepth uint32
+	NrValues   uint32
+	Sizes      [MAX_TRACES]uint32
+	Comm       [TASK_COMM_LEN]byte
+	Values     [MAX_TRACES][MAX_VALUE_SIZE]byte
+}
+
+// Value is a traced expression like "sk->sk_state == 1" resolved with BTF.
+type Value struct {
+	expr   string
+	typeId uint32
+	trace  TraceValue
+}
+
+type Func struct {
+	name    string
+	ip      uint64
+	protoId uint32
+	values  []Value
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	stack      bool
+	mode       string
+	info       bool
+	specs      []string
+	modeFlags  uint32
+}
+
+var opts = Options{
+	bpfObjPath: "ksnoop.bpf.o",
+	verbose:    false,
+	pid:        0,
+	stack:      false,
+	mode:       "both",
+	info:       false,
+	modeFlags:  KSNOOP_F_ENTRY | KSNOOP_F_RETURN,
+}
+
+var (
+	funcSpecRe = regexp.MustCompile(`^\s*([A-Za-z_]\w*)\s*(?:\((.*)\))?\s*$`)
+	exprRe     = regexp.MustCompile(`^([A-Za-z_]\w*)((?:->|\.)[\w.]+)?(?:\s*(==|!=|>|<)\s*(\S+))?$`)
+	argNRe     = regexp.MustCompile(`^arg([1-9])$`)
+)
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Trace this process ID only")
+	flag.BoolVarP(&opts.stack, "stack", "s", opts.stack,
+		"Only trace a function when it is called by the previous function in the list")
+	flag.StringVarP(&opts.mode, "mode", "m", opts.mode, "Trace function entry, return or both [entry, return, both]")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] [info|trace] FUNC_SPEC [FUNC_SPEC...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "FUNC_SPEC is a function, optionally followed by the values to trace, e.g.\n")
+		fmt.Fprintf(os.Stderr, "  tcp_sendmsg\n  \"tcp_sendmsg(sk->sk_state, size)\"\n  \"tcp_sendmsg(arg1->sk_state == 1, return)\"\n\n")
+		flag.PrintDefaults()
+	}
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	switch opts.mode {
+	case "entry":
+		opts.modeFlags = KSNOOP_F_ENTRY
+	case "return":
+		opts.modeFlags = KSNOOP_F_RETURN
+	case "both":
+		opts.modeFlags = KSNOOP_F_ENTRY | KSNOOP_F_RETURN
+	default:
+		log.Fatalf("Invalid mode: %s\n", opts.mode)
+	}
+	args := flag.Args()
+	if len(args) > 0 && (args[0] == "info" || args[0] == "trace") {
+		opts.info = args[0] == "info"
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if len(args) > MAX_FUNC_TRACES {
+		log.Fatalf("Too many functions, at most %d can be traced\n", MAX_FUNC_TRACES)
+	}
+	opts.specs = args
+}
+
+// splitArgs splits the values of a function spec on top-level commas.
+func splitArgs(s string) []string {
+	var ret []string
+	for _, arg := range strings.Split(s, ",") {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			ret = append(ret, arg)
+		}
+	}
+	return ret
+}
+
+func findMember(btf *common.BTF, typeId uint32, name string) (*common.BTFMember, error) {
+	m, err := btf.FindMember(typeId, name)
+	if err == nil {
+		return m, nil
+	}
+	/* struct sock fields like sk_state are macros for __sk_common.skc_state */
+	if strings.HasPrefix(name, "sk_") && btf.TypeName(btf.SkipModsAndTypedefs(typeId)) == "struct sock" {
+		skc, cerr := btf.FindMember(typeId, "__sk_common")
+		if cerr != nil {
+			return nil, err
+		}
+		m, cerr = btf.FindMember(skc.Type, "skc_"+strings.TrimPrefix(name, "sk_"))
+		if cerr != nil {
+			return nil, err
+		}
+		m.BitOffset += skc.BitOffset
+		return m, nil
+	}
+	return nil, err
+}
+
+// pointee returns the struct or union a type points to, if any.
+func pointee(btf *common.BTF, typeId uint32) (uint32, bool) {
+	t := btf.TypeByID(btf.SkipModsAndTypedefs(typeId))
+	if t == nil || t.Kind != common.BTF_KIND_PTR {
+		return 0, false
+	}
+	target := btf.TypeByID(btf.SkipModsAndTypedefs(t.Type))
+	if target == nil || (target.Kind != common.BTF_KIND_STRUCT && target.Kind != common.BTF_KIND_UNION) {
+		return 0, false
+	}
+	return t.Type, true
+}
+
+func parseValue(btf *common.BTF, fn *Func, expr string) (Value, error) {
+	v := Value{expr: expr}
+	m := exprRe.FindStringSubmatch(strings.TrimSpace(expr))
+	if m == nil {
+		return v, fmt.Errorf("invalid value %q", expr)
+	}
+	base, path, op, predicate := m[1], m[2], m[3], m[4]
+	v.expr = base + path
+
+	proto := btf.TypeByID(fn.protoId)
+	var baseType uint32
+	switch {
+	case base == "return":
+		v.trace.BaseArg = KSNOOP_RETURN
+		baseType = proto.Type
+		if baseType == 0 {
+			return v, fmt.Errorf("%s returns void", fn.name)
+		}
+	case argNRe.MatchString(base):
+		n, _ := strconv.Atoi(base[3:])
+		if n > len(proto.Params) || n > MAX_ARGS {
+			return v, fmt.Errorf("%s has no %s", fn.name, base)
+		}
+		v.trace.BaseArg = uint32(KSNOOP_ARG1 + n - 1)
+		baseType = proto.Params[n-1].Type
+	default:
+		found := false
+		for i, p := range proto.Params {
+			if p.Name == base && i < MAX_ARGS {
+				v.trace.BaseArg = uint32(KSNOOP_ARG1 + i)
+				baseType = p.Type
+				found = true
+			}
+		}
+		if !found {
+			return v, fmt.Errorf("%s has no argument %s", fn.name, base)
+		}
+	}
+
+	switch {
+	case path == "":
+		/* pointers to structs are shown as the struct they point to */
+		if target, ok := pointee(btf, baseType); ok {
+			size, err := btf.TypeSize(target)
+			if err != nil {
+				return v, err
+			}
+			v.trace.Flags |= KSNOOP_F_PTR
+			v.trace.Size = size
+			v.typeId = target
+			break
+		}
+		size, err := btf.TypeSize(baseType)
+		if err != nil {
+			return v, err
+		}
+		if size > 8 {
+			return v, fmt.Errorf("%s is too large to be passed in a register", expr)
+		}
+		v.trace.Size = size
+		v.typeId = baseType
+	case strings.HasPrefix(path, "->"):
+		target, ok := pointee(btf, baseType)
+		if !ok {
+			return v, fmt.Errorf("%s is not a pointer to a struct or union", base)
+		}
+		var bitOffset uint32
+		typeId := target
+		for _, name := range strings.Split(path[2:], ".") {
+			member, err := findMember(btf, typeId, name)
+			if err != nil {
+				return v, err
+			}
+			if member.BitSize > 0 {
+				return v, fmt.Errorf("bitfield %s is not supported", name)
+			}
+			bitOffset += member.BitOffset
+			typeId = member.Type
+		}
+		size, err := btf.TypeSize(typeId)
+		if err != nil {
+			return v, err
+		}
+		v.trace.Flags |= KSNOOP_F_PTR
+		v.trace.Offset = bitOffset / 8
+		v.trace.Size = size
+		v.typeId = typeId
+	default:
+		return v, fmt.Errorf("invalid value %q, only members of pointers (->) are supported", expr)
+	}
+	if v.trace.Size > MAX_VALUE_SIZE {
+		v.trace.Size = MAX_VALUE_SIZE
+	}
+
+	if op != "" {
+		t := btf.TypeByID(btf.SkipModsAndTypedefs(v.typeId))
+		switch t.Kind {
+		case common.BTF_KIND_INT, common.BTF_KIND_ENUM, common.BTF_KIND_ENUM64, common.BTF_KIND_PTR:
+		default:
+			return v, fmt.Errorf("predicates are only supported on integers and pointers: %s", expr)
+		}
+		if v.trace.Size > 8 || v.trace.Size&(v.trace.Size-1) != 0 {
+			return v, fmt.Errorf("predicates are not supported on values of size %d: %s", v.trace.Size, expr)
+		}
+		if t.Kind == common.BTF_KIND_INT && t.IntEncoding&common.BTF_INT_SIGNED != 0 {
+			v.trace.Flags |= KSNOOP_F_SIGNED
+		}
+		if n, err := strconv.ParseInt(predicate, 0, 64); err == nil {
+			v.trace.PredicateValue = uint64(n)
+		} else if n, err := strconv.ParseUint(predicate, 0, 64); err == nil {
+			v.trace.PredicateValue = n
+		} else {
+			return v, fmt.Errorf("invalid predicate value %s: %s", predicate, expr)
+		}
+		v.trace.Flags |= predicateFlags[op]
+	}
+	return v, nil
+}
+
+func parseFuncSpec(btf *common.BTF, ksyms *common.Ksyms, spec string) (*Func, error) {
+	m := funcSpecRe.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, fmt.Errorf("invalid function spec %q", spec)
+	}
+	fn := &Func{name: m[1]}
+	funcId, err := btf.FindByName(fn.name, common.BTF_KIND_FUNC)
+	if err != nil {
+		return nil, fmt.Errorf("function %s is not found in BTF", fn.name)
+	}
+	fn.protoId = btf.TypeByID(funcId).Type
+	if ksym := ksyms.GetSymbol(fn.name); ksym != nil {
+		fn.ip = ksym.Addr
+	}
+
+	exprs := splitArgs(m[2])
+	if len(exprs) == 0 {
+		/* trace all arguments and the return value by default */
+		proto := btf.TypeByID(fn.protoId)
+		for i, p := range proto.Params {
+			if i >= MAX_ARGS || p.Name == "" {
+				break
+			}
+			exprs = append(exprs, p.Name)
+		}
+		if proto.Type != 0 {
+			exprs = append(exprs, "return")
+		}
+	}
+	if len(exprs) > MAX_TRACES {
+		return nil, fmt.Errorf("too many values for %s, at most %d can be traced", fn.name, MAX_TRACES)
+	}
+	for _, expr := range exprs {
+		v, err := parseValue(btf, fn, expr)
+		if err != nil {
+			return nil, err
+		}
+		fn.values = append(fn.values, v)
+	}
+	return fn, nil
+}
+
+func printInfo(btf *common.BTF, funcs []*Func) {
+	for _, fn := range funcs {
+		proto := btf.TypeByID(fn.protoId)
+		var params []string
+		for _, p := range proto.Params {
+			params = append(params, fmt.Sprintf("%s %s", btf.TypeName(p.Type), p.Name))
+		}
+		fmt.Printf("%s %s(%s);\n", btf.TypeName(proto.Type), fn.name, strings.Join(params, ", "))
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_tgid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.stack {
+		if err := bpfModule.InitGlobalVariable("stack_mode", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module, funcs []*Func) {
+	traces, err := bpfModule.GetMap("traces")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for i, fn := range funcs {
+		config := TraceConfig{
+			Flags:    opts.modeFlags,
+			NrValues: uint32(len(fn.values)),
+		}
+		if opts.stack && i > 0 {
+			config.ParentIp = funcs[i-1].ip
+		}
+		for j, v := range fn.values {
+			config.Values[j] = v.trace
+		}
+		ip := fn.ip
+		if err := traces.Update(unsafe.Pointer(&ip), unsafe.Pointer(&config)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module, funcs []*Func) {
+	entryProg, err := bpfModule.GetProgram("kprobe_entry")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	returnProg, err := bpfModule.GetProgram("kretprobe_return")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, fn := range funcs {
+		if _, err := entryProg.AttachKprobe(fn.name); err != nil {
+			log.Fatalf("failed to attach to %s: %s", fn.name, err)
+		}
+		/* the return probe is needed even in entry mode to keep track of the call stack */
+		if _, err := returnProg.AttachKretprobe(fn.name); err != nil {
+			log.Fatalf("failed to attach to %s: %s", fn.name, err)
+		}
+	}
+}
+
+func printEvent(data []byte, btf *common.BTF, funcsByIp map[uint64]*Func) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	fn, ok := funcsByIp[e.Ip]
+	if !ok {
+		return
+	}
+	indent := strings.Repeat("  ", int(e.StackDepth))
+	prefix := fmt.Sprintf("%31s%s", "", indent)
+	fmt.Printf("%16d %4d %8d %s", e.Ts, e.Cpu, e.Pid, indent)
+
+	var values []string
+	for i, v := range fn.values {
+		if i >= int(e.NrValues) || e.Sizes[i] == 0 {
+			continue
+		}
+		size := e.Sizes[i]
+		if size > MAX_VALUE_SIZE {
+			size = MAX_VALUE_SIZE
+		}
+		value := btf.FormatValue(v.typeId, e.Values[i][:size])
+		values = append(values, strings.ReplaceAll(value, "\n", "\n"+prefix+"    "))
+	}
+
+	if e.Flags&KSNOOP_F_RETURN != 0 {
+		ret := "void"
+		if len(values) > 0 {
+			ret = strings.Join(values, ", ")
+		}
+		fmt.Printf("%s() = %s;\n", fn.name, ret)
+		return
+	}
+	if len(values) == 0 {
+		fmt.Printf("%s();\n", fn.name)
+		return
+	}
+	fmt.Printf("%s(\n", fn.name)
+	var j int
+	for i, v := range fn.values {
+		if i >= int(e.NrValues) || e.Sizes[i] == 0 {
+			continue
+		}
+		sep := ","
+		if j == len(values)-1 {
+			sep = ""
+		}
+		fmt.Printf("%s    %s = %s%s\n", prefix, v.expr, values[j], sep)
+		j++
+	}
+	fmt.Printf("%s);\n", prefix)
+}
+
+func main() {
+	parseArgs()
+
+	btf, err := common.LoadVmlinuxBTF()
+	if err != nil {
+		log.Fatalf("failed to load vmlinux BTF: %s", err)
+	}
+	ksyms, err := common.LoadKsyms()
+	if err != nil {
+		log.Fatalf("failed to load kallsyms: %s", err)
+	}
+	var funcs []*Func
+	funcsByIp := map[uint64]*Func{}
+	for _, spec := range opts.specs {
+		fn, err := parseFuncSpec(btf, ksyms, spec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !opts.info && fn.ip == 0 {
+			log.Fatalf("function %s is not found in kallsyms", fn.name)
+		}
+		funcs = append(funcs, fn)
+		funcsByIp[fn.ip] = fn
+	}
+	if opts.info {
+		printInfo(btf, funcs)
+		return
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule, funcs)
+	attachPrograms(bpfModule, funcs)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	fmt.Printf("%16s %4s %8s %s\n", "TIME", "CPU", "PID", "FUNCTION/ARGS")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data, btf, funcsByIp)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
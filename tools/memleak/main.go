@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/aquasecurity/libbpfgo/helpers"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const BPF_F_USER_STACK = 1 << 8
+
+type AllocInfo struct {
+	Size        uint64
+	TimestampNs uint64
+	StackId     int32
+	_           [4]byte
+}
+
+type Stack struct {
+	StackId int32
+	Size    uint64
+	Count   uint64
+}
+
+type Options struct {
+	bpfObjPath    string
+	verbose       bool
+	pid           int32
+	kernel        bool
+	showAllocs    bool
+	older         uint64
+	combinedOnly  bool
+	waMissingFree bool
+	sampleRate    uint64
+	top           int
+	minSize       uint64
+	maxSize       uint64
+	libc          string
+	interval      uint64
+	count         uint64
+}
+
+var opts = Options{
+	bpfObjPath:    "memleak.bpf.o",
+	verbose:       false,
+	pid:           0,
+	kernel:        false,
+	showAllocs:    false,
+	older:         500,
+	combinedOnly:  false,
+	waMissingFree: false,
+	sampleRate:    1,
+	top:           10,
+	minSize:       0,
+	maxSize:       0,
+	libc:          "",
+	interval:      5,
+	count:         99999999,
+}
+
+// allocFuncs are the libc functions traced in user mode, optional ones may
+// be missing from the libc.
+var allocFuncs = []struct {
+	name     string
+	entry    string
+	exit     string
+	optional bool
+}{
+	{"malloc", "malloc_enter", "malloc_exit", false},
+	{"calloc", "calloc_enter", "calloc_exit", false},
+	{"realloc", "realloc_enter", "realloc_exit", false},
+	{"mmap", "mmap_enter", "mmap_exit", false},
+	{"posix_memalign", "posix_memalign_enter", "posix_memalign_exit", false},
+	{"aligned_alloc", "aligned_alloc_enter", "aligned_alloc_exit", true},
+	{"valloc", "valloc_enter", "valloc_exit", true},
+	{"memalign", "memalign_enter", "memalign_exit", true},
+	{"free", "free_enter", "", false},
+	{"munmap", "munmap_enter", "", false},
+}
+
+// kmemTracepoints maps the kernel programs to their tracepoints.
+var kmemTracepoints = map[string]string{
+	"memleak__kmalloc":               "kmalloc",
+	"memleak__kmalloc_node":          "kmalloc_node",
+	"memleak__kfree":                 "kfree",
+	"memleak__kmem_cache_alloc":      "kmem_cache_alloc",
+	"memleak__kmem_cache_alloc_node": "kmem_cache_alloc_node",
+	"memleak__kmem_cache_free":       "kmem_cache_free",
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Process ID to trace, if not specified, trace kernel allocs")
+	flag.BoolVarP(&opts.kernel, "kernel", "k", opts.kernel, "Trace kernel allocs, of the process specified with -p only")
+	flag.BoolVarP(&opts.showAllocs, "show-allocs", "a", opts.showAllocs,
+		"Show allocation addresses and sizes as well as call stacks")
+	flag.Uint64VarP(&opts.older, "older", "o", opts.older,
+		"Prune allocations younger than this age in milliseconds")
+	flag.BoolVarP(&opts.combinedOnly, "combined-only", "C", opts.combinedOnly,
+		"Show combined allocation statistics only")
+	flag.BoolVar(&opts.waMissingFree, "wa-missing-free", opts.waMissingFree,
+		"Workaround to alleviate misjudgments when free is missing")
+	flag.Uint64VarP(&opts.sampleRate, "sample-rate", "s", opts.sampleRate,
+		"Sample every N-th allocation to decrease the overhead")
+	flag.IntVarP(&opts.top, "top", "T", opts.top, "Display only this many top allocating stacks (by size)")
+	flag.Uint64VarP(&opts.minSize, "min-size", "z", opts.minSize, "Capture only allocations larger than this size")
+	flag.Uint64VarP(&opts.maxSize, "max-size", "Z", opts.maxSize, "Capture only allocations smaller than this size")
+	flag.StringVarP(&opts.libc, "obj", "O", opts.libc, "Attach to allocator functions in the specified object")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.pid <= 0 {
+		opts.kernel = true
+	}
+	if opts.sampleRate == 0 {
+		log.Fatalln("Invalid sample rate: 0")
+	}
+	if opts.maxSize > 0 && opts.minSize > opts.maxSize {
+		log.Fatalln("min-size should be smaller than max-size")
+	}
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.count = uint64(count)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.minSize > 0 {
+		if err := bpfModule.InitGlobalVariable("min_size", opts.minSize); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.maxSize > 0 {
+		if err := bpfModule.InitGlobalVariable("max_size", opts.maxSize); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.sampleRate > 1 {
+		if err := bpfModule.InitGlobalVariable("sample_rate", opts.sampleRate); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.waMissingFree {
+		if err := bpfModule.InitGlobalVariable("wa_missing_free", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.kernel && opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_tgid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if !opts.kernel {
+		if err := bpfModule.InitGlobalVariable("stack_flags", uint64(BPF_F_USER_STACK)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		tp, isKernel := kmemTracepoints[prog.Name()]
+		autoload := isKernel == opts.kernel
+		/* kmalloc_node and kmem_cache_alloc_node are removed in 6.0 */
+		if isKernel && !common.TracepointExists("kmem", tp) {
+			autoload = false
+		}
+		if !autoload {
+			if err := prog.SetAutoload(false); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachUprobes(bpfModule *bpf.Module) {
+	libcPath := opts.libc
+	if libcPath == "" {
+		var err error
+		libcPath, err = common.GetPidLibPath(int(opts.pid), "c")
+		if err != nil {
+			log.Fatalf("could not find libc.so: %s", err)
+		}
+	}
+	for _, f := range allocFuncs {
+		funcOff, err := helpers.SymbolToOffset(libcPath, f.name)
+		if err != nil || funcOff <= 0 {
+			if f.optional {
+				continue
+			}
+			log.Fatalf("could not find %s in %s\n", f.name, libcPath)
+		}
+		entryProg, err := bpfModule.GetProgram(f.entry)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if _, err := entryProg.AttachUprobe(int(opts.pid), libcPath, funcOff); err != nil {
+			log.Fatalf("failed to attach %s: %s", f.name, err)
+		}
+		if f.exit == "" {
+			continue
+		}
+		exitProg, err := bpfModule.GetProgram(f.exit)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if _, err := exitProg.AttachURetprobe(int(opts.pid), libcPath, funcOff); err != nil {
+			log.Fatalf("failed to attach %s: %s", f.name, err)
+		}
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	if !opts.kernel {
+		attachUprobes(bpfModule)
+		return
+	}
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		tp, ok := kmemTracepoints[prog.Name()]
+		if !ok || !common.TracepointExists("kmem", tp) {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+type Symbolizer struct {
+	stackTraces *bpf.BPFMap
+	ksyms       *common.Ksyms
+	syms        *common.Syms
+}
+
+func (s *Symbolizer) frames(stackId int32) []string {
+	if stackId < 0 {
+		return []string{"[Missed Stack]"}
+	}
+	id := uint32(stackId)
+	raw, err := s.stackTraces.GetValue(unsafe.Pointer(&id))
+	if err != nil {
+		return []string{"[Missed Stack]"}
+	}
+	var frames []string
+	for i := 0; i+8 <= len(raw); i += 8 {
+		addr := binary.LittleEndian.Uint64(raw[i : i+8])
+		if addr == 0 {
+			break
+		}
+		frame := fmt.Sprintf("0x%016x [unknown]", addr)
+		if s.ksyms != nil {
+			if ksym := s.ksyms.MapAddr(addr); ksym != nil {
+				frame = fmt.Sprintf("0x%016x %s+0x%x", addr, ksym.Name, addr-ksym.Addr)
+			}
+		} else if s.syms != nil {
+			if sym, dso, offset := s.syms.MapAddrDso(addr); sym != nil {
+				frame = fmt.Sprintf("0x%016x %s+0x%x [%s]", addr, sym.Name, sym.Offset, dso)
+			} else if dso != "" {
+				frame = fmt.Sprintf("0x%016x [unknown] [%s+0x%x]", addr, dso, offset)
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func outstandingStacks(allocs *bpf.BPFMap) []Stack {
+	items, err := common.DumpHash(allocs)
+	if err != nil {
+		log.Fatalf("failed to dump allocs: %s", err)
+	}
+	now, err := common.MonotonicTimeNs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return aggregateAllocs(items, now, opts.older*uint64(time.Millisecond))
+}
+
+// aggregateAllocs sums the allocations of the allocs map by stack, leaving
+// out the ones younger than olderNs at now.
+func aggregateAllocs(items [][2][]byte, now, olderNs uint64) []Stack {
+	stacks := map[int32]*Stack{}
+	for _, item := range items {
+		address := binary.LittleEndian.Uint64(item[0])
+		var info AllocInfo
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &info); err != nil {
+			log.Fatalln(err)
+		}
+		if now < info.TimestampNs || now-info.TimestampNs < olderNs {
+			continue
+		}
+		if opts.showAllocs {
+			fmt.Printf("\taddr = %x size = %d\n", address, info.Size)
+		}
+		stack, ok := stacks[info.StackId]
+		if !ok {
+			stack = &Stack{StackId: info.StackId}
+			stacks[info.StackId] = stack
+		}
+		stack.Size += info.Size
+		stack.Count++
+	}
+	var ret []Stack
+	for _, stack := range stacks {
+		ret = append(ret, *stack)
+	}
+	return ret
+}
+
+func combinedStacks(combinedAllocs *bpf.BPFMap) []Stack {
+	items, err := common.DumpHash(combinedAllocs)
+	if err != nil {
+		log.Fatalf("failed to dump combined allocs: %s", err)
+	}
+	return decodeCombinedAllocs(items)
+}
+
+// decodeCombinedAllocs decodes the combined_allocs map, whose values are
+// union combined_alloc_info: the total size in the low 40 bits and the
+// number of allocations in the high 24 bits.
+func decodeCombinedAllocs(items [][2][]byte) []Stack {
+	var ret []Stack
+	for _, item := range items {
+		bits := binary.LittleEndian.Uint64(item[1])
+		stack := Stack{
+			StackId: int32(binary.LittleEndian.Uint64(item[0])),
+			Size:    bits & (1<<40 - 1),
+			Count:   bits >> 40,
+		}
+		if stack.Count == 0 {
+			continue
+		}
+		ret = append(ret, stack)
+	}
+	return ret
+}
+
+func printOutstanding(bpfModule *bpf.Module, s *Symbolizer) {
+	var stacks []Stack
+	if opts.combinedOnly {
+		combinedAllocs, err := bpfModule.GetMap("combined_allocs")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		stacks = combinedStacks(combinedAllocs)
+	} else {
+		allocs, err := bpfModule.GetMap("allocs")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		stacks = outstandingStacks(allocs)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].Size > stacks[j].Size
+	})
+	if len(stacks) > opts.top {
+		stacks = stacks[:opts.top]
+	}
+
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("[%s] Top %d stacks with outstanding allocations:\n", ts, len(stacks))
+	for _, stack := range stacks {
+		fmt.Printf("\t%d bytes in %d allocations from stack\n", stack.Size, stack.Count)
+		fmt.Printf("\t\t%s\n", strings.Join(s.frames(stack.StackId), "\n\t\t"))
+	}
+}
+
+func main() {
+	parseArgs()
+
+	symbolizer := &Symbolizer{}
+	if opts.kernel {
+		ksyms, err := common.LoadKsyms()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		symbolizer.ksyms = ksyms
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	if symbolizer.stackTraces, err = bpfModule.GetMap("stack_traces"); err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	count := opts.count
+	if opts.kernel {
+		fmt.Printf("Attaching to kernel allocators, Ctrl+C to quit.\n")
+	} else {
+		fmt.Printf("Attaching to pid %d, Ctrl+C to quit.\n", opts.pid)
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		if !opts.kernel {
+			/* reload the maps of the process, as it may have loaded new libraries */
+			if symbolizer.syms, err = common.NewSymsCache().GetSyms(int(opts.pid)); err != nil {
+				log.Printf("failed to load symbols of pid %d: %s", opts.pid, err)
+			}
+		}
+		printOutstanding(bpfModule, symbolizer)
+
+		count--
+		if end || count == 0 {
+			break loop
+		}
+	}
+}
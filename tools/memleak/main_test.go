@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func encode(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sortStacks(stacks []Stack) []Stack {
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].StackId < stacks[j].StackId
+	})
+	return stacks
+}
+
+func TestDecodeCombinedAllocs(t *testing.T) {
+	tests := []struct {
+		name    string
+		stackId uint64
+		bits    uint64
+		want    []Stack
+	}{
+		{name: "small", stackId: 1, bits: 3<<40 | 96, want: []Stack{{StackId: 1, Size: 96, Count: 3}}},
+		{name: "max size", stackId: 2, bits: 1<<40 | (1<<40 - 1), want: []Stack{{StackId: 2, Size: 1<<40 - 1, Count: 1}}},
+		{name: "max count", stackId: 3, bits: (1<<24-1)<<40 | 8, want: []Stack{{StackId: 3, Size: 8, Count: 1<<24 - 1}}},
+		{name: "freed", stackId: 4, bits: 0, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := [][2][]byte{{encode(t, tt.stackId), encode(t, tt.bits)}}
+			if got := decodeCombinedAllocs(items); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeCombinedAllocs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateAllocs(t *testing.T) {
+	allocs := []struct {
+		address uint64
+		info    AllocInfo
+	}{
+		{0x1000, AllocInfo{Size: 16, TimestampNs: 100, StackId: 1}},
+		{0x2000, AllocInfo{Size: 32, TimestampNs: 500, StackId: 1}},
+		{0x3000, AllocInfo{Size: 64, TimestampNs: 900, StackId: 2}},
+		/* allocated after now was read */
+		{0x4000, AllocInfo{Size: 128, TimestampNs: 1100, StackId: 2}},
+	}
+	var items [][2][]byte
+	for _, a := range allocs {
+		items = append(items, [2][]byte{encode(t, a.address), encode(t, a.info)})
+	}
+
+	tests := []struct {
+		name    string
+		olderNs uint64
+		want    []Stack
+	}{
+		{name: "all", olderNs: 0, want: []Stack{{StackId: 1, Size: 48, Count: 2}, {StackId: 2, Size: 64, Count: 1}}},
+		{name: "older", olderNs: 500, want: []Stack{{StackId: 1, Size: 48, Count: 2}}},
+		{name: "oldest", olderNs: 600, want: []Stack{{StackId: 1, Size: 16, Count: 1}}},
+		{name: "none", olderNs: 2000, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sortStacks(aggregateAllocs(items, 1000, tt.olderNs))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregateAllocs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+type Stats struct {
+	Latency uint64
+	Num     uint64
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+}
+
+var opts = Options{
+	bpfObjPath: "numamove.bpf.o",
+	verbose:    false,
+}
+
+// migrateFuncs are the kernel functions which migrate misplaced pages, in
+// order of preference. migrate_misplaced_page was converted to folios in newer
+// kernels.
+var migrateFuncs = []string{"migrate_misplaced_folio", "migrate_misplaced_page"}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+}
+
+type attachPoint struct {
+	progName string
+	target   string
+}
+
+func findTarget(exists func(string) bool) string {
+	for _, f := range migrateFuncs {
+		if exists(f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// setAttachTargets picks the fentry/fexit programs if the kernel supports
+// them, and the kprobe/kretprobe ones otherwise.
+func setAttachTargets(bpfModule *bpf.Module) []attachPoint {
+	progNames := []string{"fentry_migrate_misplaced", "fexit_migrate_misplaced_exit"}
+	disabled := []string{"kprobe_migrate_misplaced", "kretprobe_migrate_misplaced_exit"}
+	target := findTarget(common.FentryCanAttach)
+	if target == "" {
+		progNames, disabled = disabled, progNames
+		target = findTarget(common.KprobeExists)
+	}
+	if target == "" {
+		log.Fatalf("failed to find any of %s to trace", strings.Join(migrateFuncs, ", "))
+	}
+
+	var points []attachPoint
+	for _, name := range progNames {
+		prog, err := bpfModule.GetProgram(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if prog.GetType() == bpf.BPFProgTypeTracing {
+			if err := prog.SetAttachTarget(0, target); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		points = append(points, attachPoint{name, target})
+	}
+	for _, name := range disabled {
+		prog, err := bpfModule.GetProgram(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return points
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module, points []attachPoint) {
+	for _, p := range points {
+		prog, err := bpfModule.GetProgram(p.progName)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		switch {
+		case strings.HasPrefix(p.progName, "kprobe_"):
+			_, err = prog.AttachKprobe(p.target)
+		case strings.HasPrefix(p.progName, "kretprobe_"):
+			_, err = prog.AttachKretprobe(p.target)
+		default:
+			_, err = prog.AttachGeneric()
+		}
+		if err != nil {
+			log.Fatalf("failed to attach %s to %s: %s", p.progName, p.target, err)
+		}
+	}
+}
+
+func printAndResetStats(bss *bpf.BPFMap) {
+	values, err := common.DumpThenClearArray(bss)
+	if err != nil {
+		log.Fatalf("failed to read stats: %s", err)
+	}
+	var stats Stats
+	if len(values) > 0 {
+		if err := binary.Read(bytes.NewReader(values[0]), binary.LittleEndian, &stats); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("%-10s %18d %18d\n", ts, stats.Num, stats.Latency)
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	points := setAttachTargets(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, points)
+
+	bss, err := bpfModule.GetMap(".bss")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	fmt.Printf("%-10s %18s %18s\n", "TIME", "NUMA_migrations", "NUMA_migrations_ms")
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+
+		printAndResetStats(bss)
+	}
+}
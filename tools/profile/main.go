@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN = 16
+	MAX_PID_NR    = 30
+	MAX_TID_NR    = 30
+	EFAULT        = 14
+)
+
+type KeyT struct {
+	Pid         uint32
+	UserStackId int32
+	KernStackId int32
+	Name        [TASK_COMM_LEN]byte
+}
+
+type Sample struct {
+	Key   KeyT
+	Count uint64
+}
+
+type Options struct {
+	bpfObjPath        string
+	verbose           bool
+	pids              string
+	tids              string
+	userStacksOnly    bool
+	kernelStacksOnly  bool
+	freq              uint64
+	delimiter         bool
+	annotations       bool
+	includeIdle       bool
+	folded            bool
+	pprof             string
+	cpu               int
+	cgroup            string
+	perfMaxStackDepth uint32
+	stackStorageSize  uint32
+	duration          uint64
+	pidList           []uint32
+	tidList           []uint32
+}
+
+var opts = Options{
+	bpfObjPath:        "profile.bpf.o",
+	verbose:           false,
+	pids:              "",
+	tids:              "",
+	userStacksOnly:    false,
+	kernelStacksOnly:  false,
+	freq:              49,
+	delimiter:         false,
+	annotations:       false,
+	includeIdle:       false,
+	folded:            false,
+	pprof:             "",
+	cpu:               -1,
+	cgroup:            "",
+	perfMaxStackDepth: 127,
+	stackStorageSize:  1024,
+	duration:          0,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.StringVarP(&opts.pids, "pid", "p", opts.pids, "Profile processes with one or more comma-separated PIDs only")
+	flag.StringVarP(&opts.tids, "tid", "L", opts.tids, "Profile threads with one or more comma-separated TIDs only")
+	flag.BoolVarP(&opts.userStacksOnly, "user-stacks-only", "U", opts.userStacksOnly,
+		"Show stacks from user space only (no kernel space stacks)")
+	flag.BoolVarP(&opts.kernelStacksOnly, "kernel-stacks-only", "K", opts.kernelStacksOnly,
+		"Show stacks from kernel space only (no user space stacks)")
+	flag.Uint64VarP(&opts.freq, "frequency", "F", opts.freq, "Sample frequency, Hertz")
+	flag.BoolVarP(&opts.delimiter, "delimited", "d", opts.delimiter, "Insert delimiter between kernel/user stacks")
+	flag.BoolVarP(&opts.annotations, "annotations", "a", opts.annotations, "Add _[k] annotations to kernel frames")
+	flag.BoolVarP(&opts.includeIdle, "include-idle", "I", opts.includeIdle, "Include CPU idle stacks")
+	flag.BoolVarP(&opts.folded, "folded", "f", opts.folded, "Output folded format, one line per stack (for flame graphs)")
+	flag.StringVar(&opts.pprof, "pprof", opts.pprof, "Write the profile in pprof format to this file")
+	flag.IntVarP(&opts.cpu, "cpu", "C", opts.cpu, "CPU number to run profile on")
+	flag.StringVarP(&opts.cgroup, "cgroup", "c", opts.cgroup, "Trace process in cgroup path")
+	flag.Uint32Var(&opts.perfMaxStackDepth, "perf-max-stack-depth", opts.perfMaxStackDepth,
+		"the limit for both kernel and user stack traces (default 127)")
+	flag.Uint32Var(&opts.stackStorageSize, "stack-storage-size", opts.stackStorageSize,
+		"the number of unique stack traces that can be stored and displayed (default 1024)")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseIdList(s string, max int) ([]uint32, error) {
+	var ids []uint32
+	for _, v := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("invalid id: %s", v)
+		}
+		ids = append(ids, uint32(id))
+	}
+	if len(ids) > max {
+		return nil, fmt.Errorf("too many ids, at most %d are supported", max)
+	}
+	return ids, nil
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.userStacksOnly && opts.kernelStacksOnly {
+		log.Fatalln("user-stacks-only, kernel-stacks-only cann't be used together")
+	}
+	if opts.freq == 0 {
+		log.Fatalln("Invalid frequency: 0")
+	}
+	if opts.cpu >= 0 {
+		cpus, err := bpf.NumPossibleCPUs()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if opts.cpu >= cpus {
+			log.Fatalf("Invalid cpu: %d\n", opts.cpu)
+		}
+	}
+	var err error
+	if opts.pids != "" {
+		if opts.pidList, err = parseIdList(opts.pids, MAX_PID_NR); err != nil {
+			log.Fatalf("Invalid PID: %s\n", err)
+		}
+	}
+	if opts.tids != "" {
+		if opts.tidList, err = parseIdList(opts.tids, MAX_TID_NR); err != nil {
+			log.Fatalf("Invalid TID: %s\n", err)
+		}
+	}
+	if args := flag.Args(); len(args) > 0 {
+		duration, err := strconv.Atoi(args[0])
+		if err != nil || duration <= 0 {
+			log.Fatalf("Invalid duration: %s\n", args[0])
+		}
+		opts.duration = uint64(duration)
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.userStacksOnly {
+		if err := bpfModule.InitGlobalVariable("user_stacks_only", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.kernelStacksOnly {
+		if err := bpfModule.InitGlobalVariable("kernel_stacks_only", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.includeIdle {
+		if err := bpfModule.InitGlobalVariable("include_idle", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(opts.pidList) > 0 {
+		if err := bpfModule.InitGlobalVariable("filter_by_pid", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(opts.tidList) > 0 {
+		if err := bpfModule.InitGlobalVariable("filter_by_tid", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.cgroup != "" {
+		if err := bpfModule.InitGlobalVariable("filter_cg", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+	filters := []struct {
+		name string
+		ids  []uint32
+	}{
+		{"pids", opts.pidList},
+		{"tids", opts.tidList},
+	}
+	for _, filter := range filters {
+		if len(filter.ids) == 0 {
+			continue
+		}
+		m, err := bpfModule.GetMap(filter.name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, id := range filter.ids {
+			id := id
+			val := uint8(1)
+			if err := m.Update(unsafe.Pointer(&id), unsafe.Pointer(&val)); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	if opts.cgroup != "" {
+		idx := 0
+		cgroupFd, err := common.GetCgroupDirFD(opts.cgroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cgroupMap, err := bpfModule.GetMap("cgroup_map")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := cgroupMap.Update(unsafe.Pointer(&idx), unsafe.Pointer(&cgroupFd)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module) []int {
+	var fds []int
+	if opts.cpu >= 0 {
+		fd, err := common.OpenPerfEvent(common.PERF_TYPE_SOFTWARE, common.PERF_COUNT_SW_CPU_CLOCK, opts.freq, opts.cpu)
+		if err != nil {
+			log.Fatalf("failed to init perf sampling on cpu %d: %s", opts.cpu, err)
+		}
+		fds = append(fds, fd)
+	} else {
+		var err error
+		fds, err = common.OpenPerfEvents(common.PERF_TYPE_SOFTWARE, common.PERF_COUNT_SW_CPU_CLOCK, opts.freq)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	prog, err := bpfModule.GetProgram("do_perf_event")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, fd := range fds {
+		if _, err := prog.AttachPerfEvent(fd); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return fds
+}
+
+type Symbolizer struct {
+	stackmap  *bpf.BPFMap
+	ksyms     *common.Ksyms
+	symsCache *common.SymsCache
+}
+
+// stack returns the addresses of a stack from the leaf to the root.
+func (s *Symbolizer) stack(stackId int32) ([]uint64, error) {
+	id := uint32(stackId)
+	raw, err := s.stackmap.GetValue(unsafe.Pointer(&id))
+	if err != nil {
+		return nil, err
+	}
+	var addrs []uint64
+	for i := 0; i+8 <= len(raw); i += 8 {
+		addr := binary.LittleEndian.Uint64(raw[i : i+8])
+		if addr == 0 {
+			break
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (s *Symbolizer) kernelFrames(stackId int32) []string {
+	/* the kernel stack is not collected at all */
+	if opts.userStacksOnly {
+		return nil
+	}
+	if stackId < 0 {
+		if stackId == -EFAULT {
+			return nil
+		}
+		return []string{"[Missed Kernel Stack]"}
+	}
+	addrs, err := s.stack(stackId)
+	if err != nil {
+		return []string{"[Missed Kernel Stack]"}
+	}
+	var frames []string
+	for _, addr := range addrs {
+		name := "[unknown]"
+		if ksym := s.ksyms.MapAddr(addr); ksym != nil {
+			name = ksym.Name
+		}
+		if opts.annotations {
+			name += "_[k]"
+		}
+		frames = append(frames, name)
+	}
+	return frames
+}
+
+func (s *Symbolizer) userFrames(pid uint32, stackId int32) []string {
+	/* the user stack is not collected at all */
+	if opts.kernelStacksOnly {
+		return nil
+	}
+	if stackId < 0 {
+		/* kernel threads have no user stack */
+		if stackId == -EFAULT || pid == 0 {
+			return nil
+		}
+		return []string{"[Missed User Stack]"}
+	}
+	addrs, err := s.stack(stackId)
+	if err != nil {
+		return []string{"[Missed User Stack]"}
+	}
+	syms, err := s.symsCache.GetSyms(int(pid))
+	var frames []string
+	for _, addr := range addrs {
+		name := "[unknown]"
+		if err == nil {
+			if sym, dso, offset := syms.MapAddrDso(addr); sym != nil {
+				name = sym.Name
+			} else if dso != "" {
+				name = fmt.Sprintf("[%s+0x%x]", dso, offset)
+			}
+		}
+		frames = append(frames, name)
+	}
+	return frames
+}
+
+func readSamples(counts *bpf.BPFMap) []Sample {
+	items, err := common.DumpHash(counts)
+	if err != nil {
+		log.Fatalf("failed to dump counts: %s", err)
+	}
+	var samples []Sample
+	for _, item := range items {
+		var sample Sample
+		if err := binary.Read(bytes.NewReader(item[0]), binary.LittleEndian, &sample.Key); err != nil {
+			log.Fatalln(err)
+		}
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &sample.Count); err != nil {
+			log.Fatalln(err)
+		}
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Count > samples[j].Count
+	})
+	return samples
+}
+
+func reversed(frames []string) []string {
+	ret := make([]string, 0, len(frames))
+	for i := len(frames) - 1; i >= 0; i-- {
+		ret = append(ret, frames[i])
+	}
+	return ret
+}
+
+func printFolded(samples []Sample, s *Symbolizer) {
+	for _, sample := range samples {
+		kframes := s.kernelFrames(sample.Key.KernStackId)
+		uframes := s.userFrames(sample.Key.Pid, sample.Key.UserStackId)
+		line := []string{common.GoString(sample.Key.Name[:])}
+		line = append(line, reversed(uframes)...)
+		if opts.delimiter && len(uframes) > 0 && len(kframes) > 0 {
+			line = append(line, "-")
+		}
+		line = append(line, reversed(kframes)...)
+		fmt.Printf("%s %d\n", strings.Join(line, ";"), sample.Count)
+	}
+}
+
+func printDefault(samples []Sample, s *Symbolizer) {
+	for _, sample := range samples {
+		kframes := s.kernelFrames(sample.Key.KernStackId)
+		uframes := s.userFrames(sample.Key.Pid, sample.Key.UserStackId)
+		for _, frame := range kframes {
+			fmt.Printf("    %s\n", frame)
+		}
+		if opts.delimiter && len(uframes) > 0 && len(kframes) > 0 {
+			fmt.Printf("    --\n")
+		}
+		for _, frame := range uframes {
+			fmt.Printf("    %s\n", frame)
+		}
+		fmt.Printf("    %-16s %s (%d)\n", "-", common.GoString(sample.Key.Name[:]), sample.Key.Pid)
+		fmt.Printf("        %d\n\n", sample.Count)
+	}
+}
+
+func writePprof(samples []Sample, s *Symbolizer) error {
+	profile := common.NewPprof("samples", "count", "cpu", "nanoseconds", int64(time.Second)/int64(opts.freq))
+	for _, sample := range samples {
+		stack := s.kernelFrames(sample.Key.KernStackId)
+		stack = append(stack, s.userFrames(sample.Key.Pid, sample.Key.UserStackId)...)
+		profile.AddSample(stack, int64(sample.Count),
+			map[string]string{"comm": common.GoString(sample.Key.Name[:])},
+			map[string]int64{"pid": int64(sample.Key.Pid)})
+	}
+	f, err := os.Create(opts.pprof)
+	if err != nil {
+		return err
+	}
+	if err := profile.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func printHeader() {
+	threads := "all threads"
+	if len(opts.pidList) > 0 {
+		threads = "PID " + opts.pids
+	} else if len(opts.tidList) > 0 {
+		threads = "TID " + opts.tids
+	}
+	stacks := "user + kernel"
+	if opts.userStacksOnly {
+		stacks = "user"
+	} else if opts.kernelStacksOnly {
+		stacks = "kernel"
+	}
+	fmt.Printf("Sampling at %d Hertz of %s by %s stack", opts.freq, threads, stacks)
+	if opts.cpu >= 0 {
+		fmt.Printf(" on CPU#%d", opts.cpu)
+	}
+	if opts.duration > 0 {
+		fmt.Printf(" for %d secs.\n", opts.duration)
+	} else {
+		fmt.Printf("... Hit Ctrl-C to end.\n")
+	}
+}
+
+func main() {
+	parseArgs()
+
+	ksyms, err := common.LoadKsyms()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.SetValueSize(opts.perfMaxStackDepth * 8); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.Resize(opts.stackStorageSize); err != nil {
+		log.Fatalln(err)
+	}
+
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	fds := attachPrograms(bpfModule)
+	defer common.ClosePerfEvents(fds)
+
+	counts, err := bpfModule.GetMap("counts")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if stackmap, err = bpfModule.GetMap("stackmap"); err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Second*time.Duration(opts.duration))
+		defer cancel()
+	}
+
+	if !opts.folded {
+		printHeader()
+	}
+	<-ctx.Done()
+
+	samples := readSamples(counts)
+	symbolizer := &Symbolizer{
+		stackmap:  stackmap,
+		ksyms:     ksyms,
+		symsCache: common.NewSymsCache(),
+	}
+	if opts.pprof != "" {
+		if err := writePprof(samples, symbolizer); err != nil {
+			log.Fatalf("failed to write pprof: %s", err)
+		}
+		return
+	}
+	if opts.folded {
+		printFolded(samples, symbolizer)
+	} else {
+		printDefault(samples, symbolizer)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/mozillazg/libbpfgo-tools/tools/slabratetop/c
+
+go 1.17
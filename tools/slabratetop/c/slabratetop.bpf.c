@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/slabratetop.bpf.c
\ No newline at end of file
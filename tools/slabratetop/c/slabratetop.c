@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/slabratetop.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/slabratetop.h
\ No newline at end of file
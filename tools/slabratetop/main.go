@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	CACHE_NAME_SIZE   = 32
+	OUTPUT_ROWS_LIMIT = 10240
+)
+
+const (
+	SORT_BY_CACHE_NAME = iota
+	SORT_BY_CACHE_COUNT
+	SORT_BY_CACHE_SIZE
+)
+
+type SlabrateInfo struct {
+	Name  [CACHE_NAME_SIZE]byte
+	Count uint64
+	Size  uint64
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	noclear    bool
+	sort       string
+	rows       uint
+	interval   uint64
+	count      uint64
+	sortBy     int
+}
+
+var opts = Options{
+	bpfObjPath: "slabratetop.bpf.o",
+	verbose:    false,
+	pid:        0,
+	noclear:    false,
+	sort:       "size",
+	rows:       20,
+	interval:   1,
+	count:      99999999,
+	sortBy:     SORT_BY_CACHE_SIZE,
+}
+
+// kmem_cache_alloc was renamed in 6.10 when memory allocation profiling was
+// introduced.
+var allocFuncs = []string{"kmem_cache_alloc", "kmem_cache_alloc_noprof"}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Process ID to trace")
+	flag.BoolVarP(&opts.noclear, "noclear", "C", opts.noclear, "Don't clear the screen")
+	flag.StringVarP(&opts.sort, "sort", "s", opts.sort, "Sort columns, default size [name, count, size]")
+	flag.UintVarP(&opts.rows, "rows", "r", opts.rows, "Maximum rows to print, default 20")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	switch opts.sort {
+	case "name":
+		opts.sortBy = SORT_BY_CACHE_NAME
+	case "count":
+		opts.sortBy = SORT_BY_CACHE_COUNT
+	case "size":
+		opts.sortBy = SORT_BY_CACHE_SIZE
+	default:
+		log.Fatalf("Invalid sort method: %s\n", opts.sort)
+	}
+	if opts.rows > OUTPUT_ROWS_LIMIT {
+		opts.rows = OUTPUT_ROWS_LIMIT
+	}
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.count = uint64(count)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("target_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+// setAutoload returns the allocation function to trace and the program for
+// it, named after the function. The programs of the other functions are not
+// loaded, or every allocation would be counted once per program. An object
+// with a single program is attached to whichever function exists.
+func setAutoload(bpfModule *bpf.Module) (string, string) {
+	var target string
+	for _, name := range allocFuncs {
+		if common.KprobeExists(name) {
+			target = name
+			break
+		}
+	}
+	if target == "" {
+		log.Fatalln("failed to find kmem_cache_alloc to trace")
+	}
+
+	var progs []*bpf.BPFProg
+	progName := ""
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		progs = append(progs, prog)
+		if prog.Name() == target {
+			progName = target
+		}
+	}
+	if progName == "" {
+		if len(progs) != 1 {
+			log.Fatalf("failed to find the program for %s", target)
+		}
+		return target, progs[0].Name()
+	}
+	for _, prog := range progs {
+		if prog.Name() == progName {
+			continue
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return target, progName
+}
+
+func attachPrograms(bpfModule *bpf.Module, target, progName string) {
+	prog, err := bpfModule.GetProgram(progName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := prog.AttachKprobe(target); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func sortColumn(values []SlabrateInfo) {
+	sort.Slice(values, func(i, j int) bool {
+		switch opts.sortBy {
+		case SORT_BY_CACHE_NAME:
+			return common.GoString(values[i].Name[:]) < common.GoString(values[j].Name[:])
+		case SORT_BY_CACHE_COUNT:
+			return values[i].Count > values[j].Count
+		default:
+			return values[i].Size > values[j].Size
+		}
+	})
+}
+
+func printStat(slabEntries *bpf.BPFMap) {
+	loadData, _ := os.ReadFile("/proc/loadavg")
+	if len(loadData) > 0 {
+		ts := time.Now().Format("15:04:05")
+		load := string(bytes.TrimSpace(loadData))
+		if load != "" {
+			fmt.Printf("%8s loadavg: %s\n", ts, load)
+		}
+	}
+
+	items, err := common.DumpThenClearHash(slabEntries)
+	if err != nil {
+		log.Fatalf("failed to dump slab_entries: %s", err)
+	}
+	var values []SlabrateInfo
+	for _, item := range items {
+		var info SlabrateInfo
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &info); err != nil {
+			log.Fatalln(err)
+		}
+		values = append(values, info)
+	}
+
+	fmt.Printf("%-32s %6s %10s\n", "CACHE", "ALLOCS", "BYTES")
+	sortColumn(values)
+	rows := len(values)
+	if rows > int(opts.rows) {
+		rows = int(opts.rows)
+	}
+	for i := 0; i < rows; i++ {
+		fmt.Printf("%-32s %6d %10d\n",
+			common.GoString(values[i].Name[:]), values[i].Count, values[i].Size)
+	}
+	fmt.Printf("\n")
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	target, progName := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, target, progName)
+
+	slabEntries, err := bpfModule.GetMap("slab_entries")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = common.RunTopLoop(common.TopLoopOptions{
+		Interval: opts.interval,
+		Count:    opts.count,
+		NoClear:  opts.noclear,
+	}, func() {
+		printStat(slabEntries)
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
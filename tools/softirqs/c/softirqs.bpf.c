@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: GPL-2.0
+/*
+ * Based on softirqs.bpf.c from bcc/libbpf-tools. Counters are kept in
+ * per-CPU arrays indexed by softirq vector, so that userspace can report
+ * them either per CPU or summed up.
+ */
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "softirqs.h"
+#include "bits.bpf.h"
+
+const volatile bool targ_dist = false;
+const volatile bool targ_ns = false;
+const volatile int targ_cpu = -1;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, u32);
+	__type(value, u64);
+} start SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, NR_SOFTIRQS);
+	__type(key, u32);
+	__type(value, u64);
+} counts SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, NR_SOFTIRQS);
+	__type(key, u32);
+	__type(value, u64);
+} time SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, NR_SOFTIRQS);
+	__type(key, u32);
+	__type(value, struct hist);
+} hists SEC(".maps");
+
+static __always_inline bool is_target_cpu(void)
+{
+	if (targ_cpu < 0)
+		return true;
+
+	return targ_cpu == bpf_get_smp_processor_id();
+}
+
+static int handle_entry(unsigned int vec_nr)
+{
+	u64 ts = bpf_ktime_get_ns();
+	u32 key = 0;
+
+	if (!is_target_cpu())
+		return 0;
+
+	bpf_map_update_elem(&start, &key, &ts, BPF_ANY);
+	return 0;
+}
+
+static int handle_exit(unsigned int vec_nr)
+{
+	u64 delta, *tsp, *countp, *timep;
+	struct hist *hist;
+	u32 key = 0;
+
+	if (vec_nr >= NR_SOFTIRQS)
+		return 0;
+	if (!is_target_cpu())
+		return 0;
+
+	tsp = bpf_map_lookup_elem(&start, &key);
+	if (!tsp || !*tsp)
+		return 0;
+
+	delta = bpf_ktime_get_ns() - *tsp;
+	if (!targ_ns)
+		delta /= 1000U;
+
+	key = vec_nr;
+	countp = bpf_map_lookup_elem(&counts, &key);
+	if (countp)
+		*countp += 1;
+
+	if (!targ_dist) {
+		timep = bpf_map_lookup_elem(&time, &key);
+		if (timep)
+			*timep += delta;
+	} else {
+		u64 slot;
+
+		hist = bpf_map_lookup_elem(&hists, &key);
+		if (!hist)
+			return 0;
+		slot = log2(delta);
+		if (slot >= MAX_SLOTS)
+			slot = MAX_SLOTS - 1;
+		hist->slots[slot]++;
+	}
+
+	return 0;
+}
+
+SEC("tp_btf/softirq_entry")
+int BPF_PROG(softirq_entry_btf, unsigned int vec_nr)
+{
+	return handle_entry(vec_nr);
+}
+
+SEC("tp_btf/softirq_exit")
+int BPF_PROG(softirq_exit_btf, unsigned int vec_nr)
+{
+	return handle_exit(vec_nr);
+}
+
+SEC("raw_tp/softirq_entry")
+int BPF_PROG(softirq_entry, unsigned int vec_nr)
+{
+	return handle_entry(vec_nr);
+}
+
+SEC("raw_tp/softirq_exit")
+int BPF_PROG(softirq_exit, unsigned int vec_nr)
+{
+	return handle_exit(vec_nr);
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const MAX_SLOTS = 20
+
+type Hist struct {
+	Slots [MAX_SLOTS]uint32
+}
+
+type Options struct {
+	bpfObjPath  string
+	verbose     bool
+	distributed bool
+	nanoseconds bool
+	count       bool
+	perCpu      bool
+	cpu         int32
+	timestamp   bool
+	interval    uint64
+	times       uint64
+}
+
+var opts = Options{
+	bpfObjPath:  "softirqs.bpf.o",
+	verbose:     false,
+	distributed: false,
+	nanoseconds: false,
+	count:       false,
+	perCpu:      false,
+	cpu:         -1,
+	timestamp:   false,
+	interval:    99999999,
+	times:       99999999,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.distributed, "distributed", "d", opts.distributed, "Show distributions as histograms")
+	flag.BoolVarP(&opts.count, "count", "C", opts.count, "Show event counts with timing")
+	flag.Int32VarP(&opts.cpu, "cpu", "s", opts.cpu, "Trace this cpu only")
+	flag.BoolVarP(&opts.perCpu, "per-cpu", "P", opts.perCpu, "Show a breakdown per CPU")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Include timestamp on output")
+	flag.BoolVarP(&opts.nanoseconds, "nanoseconds", "N", opts.nanoseconds, "Output in nanoseconds")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.count && opts.distributed {
+		log.Fatalln("count, distributed cann't be used together")
+	}
+	if opts.cpu >= 0 {
+		cpus, err := bpf.NumPossibleCPUs()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if int(opts.cpu) >= cpus {
+			log.Fatalf("Invalid cpu: %d\n", opts.cpu)
+		}
+	}
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			times, err := strconv.Atoi(args[1])
+			if err != nil || times <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.times = uint64(times)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.distributed {
+		if err := bpfModule.InitGlobalVariable("targ_dist", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.nanoseconds {
+		if err := bpfModule.InitGlobalVariable("targ_ns", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.cpu >= 0 {
+		if err := bpfModule.InitGlobalVariable("targ_cpu", opts.cpu); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) []string {
+	names := []string{"softirq_entry", "softirq_exit"}
+	disabled := []string{"softirq_entry_btf", "softirq_exit_btf"}
+	if common.VmlinuxBTFExists() {
+		names, disabled = disabled, names
+	}
+	for _, name := range disabled {
+		prog, err := bpfModule.GetProgram(name)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return names
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module, names []string) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if !common.Contains(names, prog.Name()) {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// readCounters returns the values of a per-cpu array of u64 indexed by
+// softirq vector, as values[vec][cpu].
+func readCounters(bpfMap *bpf.BPFMap) [][]uint64 {
+	items, err := common.DumpThenClearPerCPUArray(bpfMap)
+	if err != nil {
+		log.Fatalf("failed to dump %s: %s", bpfMap.Name(), err)
+	}
+	values := make([][]uint64, len(items))
+	for vec, perCpu := range items {
+		for _, v := range perCpu {
+			values[vec] = append(values[vec], binary.LittleEndian.Uint64(v))
+		}
+	}
+	return values
+}
+
+func readHists(bpfMap *bpf.BPFMap) [][]Hist {
+	items, err := common.DumpThenClearPerCPUArray(bpfMap)
+	if err != nil {
+		log.Fatalf("failed to dump %s: %s", bpfMap.Name(), err)
+	}
+	hists := make([][]Hist, len(items))
+	for vec, perCpu := range items {
+		for _, v := range perCpu {
+			var hist Hist
+			if err := binary.Read(bytes.NewReader(v), binary.LittleEndian, &hist); err != nil {
+				log.Fatalln(err)
+			}
+			hists[vec] = append(hists[vec], hist)
+		}
+	}
+	return hists
+}
+
+func sum(values []uint64) uint64 {
+	var total uint64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func printCount(countsMap, timeMap *bpf.BPFMap, units string) {
+	counts := readCounters(countsMap)
+	times := readCounters(timeMap)
+
+	if opts.perCpu {
+		fmt.Printf("%-4s ", "CPU")
+	}
+	fmt.Printf("%-16s %11s", "SOFTIRQ", "TOTAL_"+units)
+	if opts.count {
+		fmt.Printf("  %11s", "TOTAL_count")
+	}
+	fmt.Printf("\n")
+
+	printRow := func(cpu int, vec int, time, count uint64) {
+		if count == 0 {
+			return
+		}
+		if cpu >= 0 {
+			fmt.Printf("%-4d ", cpu)
+		}
+		fmt.Printf("%-16s %11d", common.SoftirqName(vec), time)
+		if opts.count {
+			fmt.Printf("  %11d", count)
+		}
+		fmt.Printf("\n")
+	}
+
+	if !opts.perCpu {
+		for vec := range counts {
+			printRow(-1, vec, sum(times[vec]), sum(counts[vec]))
+		}
+		return
+	}
+	if len(counts) == 0 {
+		return
+	}
+	for cpu := range counts[0] {
+		for vec := range counts {
+			printRow(cpu, vec, times[vec][cpu], counts[vec][cpu])
+		}
+	}
+}
+
+func printHist(countsMap, histsMap *bpf.BPFMap, units string) {
+	counts := readCounters(countsMap)
+	hists := readHists(histsMap)
+
+	printOne := func(header string, slots []int) {
+		empty := true
+		for _, v := range slots {
+			if v > 0 {
+				empty = false
+				break
+			}
+		}
+		if empty {
+			return
+		}
+		fmt.Printf("%s\n", header)
+		common.PrintLog2Hist(slots, units)
+		fmt.Printf("\n")
+	}
+
+	if !opts.perCpu {
+		for vec, perCpu := range hists {
+			slots := make([]int, MAX_SLOTS)
+			for _, hist := range perCpu {
+				for i, v := range hist.Slots {
+					slots[i] += int(v)
+				}
+			}
+			printOne(fmt.Sprintf("softirq = %s", common.SoftirqName(vec)), slots)
+		}
+		return
+	}
+	if len(hists) == 0 {
+		return
+	}
+	for cpu := range hists[0] {
+		for vec := range hists {
+			if counts[vec][cpu] == 0 {
+				continue
+			}
+			var slots []int
+			for _, v := range hists[vec][cpu].Slots {
+				slots = append(slots, int(v))
+			}
+			printOne(fmt.Sprintf("softirq = %s, cpu = %d", common.SoftirqName(vec), cpu), slots)
+		}
+	}
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	names := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, names)
+
+	countsMap, err := bpfModule.GetMap("counts")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	timeMap, err := bpfModule.GetMap("time")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	histsMap, err := bpfModule.GetMap("hists")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	times := opts.times
+	units := "usecs"
+	if opts.nanoseconds {
+		units = "nsecs"
+	}
+	fmt.Printf("Tracing soft irq event time... Hit Ctrl-C to end.\n")
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		fmt.Printf("\n")
+		if opts.timestamp {
+			ts := time.Now().Format("15:04:05")
+			fmt.Printf("%-8s\n", ts)
+		}
+		if opts.distributed {
+			printHist(countsMap, histsMap, units)
+		} else {
+			printCount(countsMap, timeMap, units)
+		}
+
+		times--
+		if end || times == 0 {
+			break loop
+		}
+	}
+}
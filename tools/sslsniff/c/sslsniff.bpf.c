@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: GPL-2.0
+/*
+ * Based on sslsniff.bpf.c from bcc/libbpf-tools. The same programs are
+ * attached to SSL_read/SSL_write of OpenSSL and BoringSSL and to
+ * gnutls_record_recv/gnutls_record_send of GnuTLS, whose arguments and
+ * return values have the same layout.
+ */
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "sslsniff.h"
+
+#define min(x, y) ((x) < (y) ? (x) : (y))
+
+const volatile pid_t targ_pid = 0;
+const volatile uid_t targ_uid = -1;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} perf_SSL_events SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, u32);
+	__type(value, struct probe_SSL_data_t);
+} ssl_data SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 10240);
+	__type(key, u32);
+	__type(value, u64);
+} start_ns SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 10240);
+	__type(key, u32);
+	__type(value, u64);
+} bufs SEC(".maps");
+
+static __always_inline bool trace_allowed(u32 uid, u32 pid)
+{
+	if (targ_pid && targ_pid != pid)
+		return false;
+	if (targ_uid != (uid_t)-1 && targ_uid != uid)
+		return false;
+	return true;
+}
+
+SEC("uprobe")
+int BPF_UPROBE(probe_SSL_rw_enter, void *ssl, void *buf, int num)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 pid = pid_tgid >> 32;
+	u32 tid = pid_tgid;
+	u32 uid = bpf_get_current_uid_gid();
+	u64 ts = bpf_ktime_get_ns();
+
+	if (!trace_allowed(uid, pid))
+		return 0;
+
+	bpf_map_update_elem(&bufs, &tid, &buf, BPF_ANY);
+	bpf_map_update_elem(&start_ns, &tid, &ts, BPF_ANY);
+	return 0;
+}
+
+static int SSL_exit(struct pt_regs *ctx, int rw)
+{
+	u32 zero = 0;
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	u32 pid = pid_tgid >> 32;
+	u32 tid = pid_tgid;
+	u32 uid = bpf_get_current_uid_gid();
+	u64 ts = bpf_ktime_get_ns();
+	struct probe_SSL_data_t *data;
+	u64 *bufp, *tsp;
+	u32 buf_copy_size;
+	long len;
+
+	if (!trace_allowed(uid, pid))
+		return 0;
+
+	bufp = bpf_map_lookup_elem(&bufs, &tid);
+	if (!bufp)
+		return 0;
+	tsp = bpf_map_lookup_elem(&start_ns, &tid);
+	if (!tsp)
+		goto cleanup;
+
+	/* the number of bytes read or written, or an error */
+	len = PT_REGS_RC(ctx);
+	if (len <= 0)
+		goto cleanup;
+
+	data = bpf_map_lookup_elem(&ssl_data, &zero);
+	if (!data)
+		goto cleanup;
+
+	data->timestamp_ns = ts;
+	data->delta_ns = ts - *tsp;
+	data->pid = pid;
+	data->tid = tid;
+	data->uid = uid;
+	data->len = (u32)len;
+	data->buf_filled = 0;
+	data->rw = rw;
+	bpf_get_current_comm(&data->comm, sizeof(data->comm));
+
+	buf_copy_size = min((size_t)MAX_BUF_SIZE, (size_t)len);
+	if (!bpf_probe_read_user(&data->buf, buf_copy_size, (char *)*bufp))
+		data->buf_filled = 1;
+	else
+		buf_copy_size = 0;
+
+	bpf_perf_event_output(ctx, &perf_SSL_events, BPF_F_CURRENT_CPU, data,
+			      sizeof(*data) - MAX_BUF_SIZE + buf_copy_size);
+
+cleanup:
+	bpf_map_delete_elem(&bufs, &tid);
+	bpf_map_delete_elem(&start_ns, &tid);
+	return 0;
+}
+
+SEC("uretprobe")
+int BPF_URETPROBE(probe_SSL_read_exit)
+{
+	return SSL_exit(ctx, SSL_READ);
+}
+
+SEC("uretprobe")
+int BPF_URETPROBE(probe_SSL_write_exit)
+{
+	return SSL_exit(ctx, SSL_WRITE);
+}
+
+char LICENSE[] SEC("license") = "GPL";
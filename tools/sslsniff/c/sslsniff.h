@@ -0,0 +1,26 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __SSLSNIFF_H
+#define __SSLSNIFF_H
+
+#define MAX_BUF_SIZE 8192
+#define TASK_COMM_LEN 16
+
+enum ssl_rw {
+	SSL_READ,
+	SSL_WRITE,
+};
+
+struct probe_SSL_data_t {
+	__u64 timestamp_ns;
+	__u64 delta_ns;
+	__u32 pid;
+	__u32 tid;
+	__u32 uid;
+	__u32 len;
+	__u32 buf_filled;
+	__u32 rw;
+	char comm[TASK_COMM_LEN];
+	__u8 buf[MAX_BUF_SIZE];
+};
+
+#endif /* __SSLSNIFF_H */
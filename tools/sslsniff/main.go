@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/aquasecurity/libbpfgo/helpers"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	MAX_BUF_SIZE  = 8192
+	TASK_COMM_LEN = 16
+)
+
+const (
+	SSL_READ = iota
+	SSL_WRITE
+)
+
+// EventHeader is struct probe_SSL_data_t without the buffer, which is only
+// sent as far as it is filled.
+type EventHeader struct {
+	TimestampNs uint64
+	DeltaNs     uint64
+	Pid         uint32
+	Tid         uint32
+	Uid         uint32
+	Len         uint32
+	BufFilled   uint32
+	Rw          uint32
+	Comm        [TASK_COMM_LEN]byte
+}
+
+// sslLib is a TLS library and the functions to attach to.
+type sslLib struct {
+	lib   string
+	read  string
+	write string
+}
+
+type Options struct {
+	bpfObjPath    string
+	verbose       bool
+	pid           int32
+	uid           int32
+	comm          string
+	noOpenSSL     bool
+	noGnuTLS      bool
+	sslLib        string
+	hexdump       bool
+	latency       bool
+	maxBufferSize uint32
+}
+
+var opts = Options{
+	bpfObjPath:    "sslsniff.bpf.o",
+	verbose:       false,
+	pid:           0,
+	uid:           -1,
+	comm:          "",
+	noOpenSSL:     false,
+	noGnuTLS:      false,
+	sslLib:        "",
+	hexdump:       false,
+	latency:       false,
+	maxBufferSize: MAX_BUF_SIZE,
+}
+
+var (
+	openSSL = sslLib{"ssl", "SSL_read", "SSL_write"}
+	gnuTLS  = sslLib{"gnutls", "gnutls_record_recv", "gnutls_record_send"}
+)
+
+var startTs uint64
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Sniff this PID only")
+	flag.Int32VarP(&opts.uid, "uid", "u", opts.uid, "Sniff this UID only")
+	flag.StringVarP(&opts.comm, "comm", "c", opts.comm, "Sniff only commands matching string")
+	flag.BoolVarP(&opts.noOpenSSL, "no-openssl", "o", opts.noOpenSSL, "Do not trace OpenSSL calls")
+	flag.BoolVarP(&opts.noGnuTLS, "no-gnutls", "g", opts.noGnuTLS, "Do not trace GnuTLS calls")
+	flag.StringVar(&opts.sslLib, "ssl-lib", opts.sslLib,
+		"Path of the OpenSSL or BoringSSL library or of a binary linked with it statically")
+	flag.BoolVarP(&opts.hexdump, "hexdump", "x", opts.hexdump, "Show data as hexdump instead of trying to decode it as UTF-8")
+	flag.BoolVarP(&opts.latency, "latency", "l", opts.latency, "Show function latency")
+	flag.Uint32Var(&opts.maxBufferSize, "max-buffer-size", opts.maxBufferSize,
+		"Size of captured buffer, data beyond it is truncated")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.maxBufferSize == 0 || opts.maxBufferSize > MAX_BUF_SIZE {
+		log.Fatalf("Invalid max buffer size, it should be in [1, %d]\n", MAX_BUF_SIZE)
+	}
+	if opts.noOpenSSL && opts.noGnuTLS {
+		log.Fatalln("no-openssl, no-gnutls cann't be used together")
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.uid >= 0 {
+		if err := bpfModule.InitGlobalVariable("targ_uid", opts.uid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+// libPaths returns the paths of lib mapped by the traced process, or by any
+// process when no process is specified.
+func libPaths(lib string) []string {
+	if opts.pid > 0 {
+		path, err := common.GetPidLibPath(int(opts.pid), lib)
+		if err != nil {
+			return nil
+		}
+		return []string{path}
+	}
+	paths, err := common.GetLibPaths(lib)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return paths
+}
+
+var errNoSymbol = errors.New("symbol not found")
+
+func attachLib(bpfModule *bpf.Module, lib sslLib, path string) error {
+	enterProg, err := bpfModule.GetProgram("probe_SSL_rw_enter")
+	if err != nil {
+		return err
+	}
+	funcs := []struct {
+		name string
+		exit string
+		off  uint32
+	}{
+		{name: lib.read, exit: "probe_SSL_read_exit"},
+		{name: lib.write, exit: "probe_SSL_write_exit"},
+	}
+	/* look up every function first so that a library is attached either fully or not at all */
+	for i, f := range funcs {
+		funcOff, err := helpers.SymbolToOffset(path, f.name)
+		if err != nil || funcOff <= 0 {
+			return fmt.Errorf("could not find %s in %s: %w", f.name, path, errNoSymbol)
+		}
+		funcs[i].off = funcOff
+	}
+	pid := -1
+	if opts.pid > 0 {
+		pid = int(opts.pid)
+	}
+	for _, f := range funcs {
+		exitProg, err := bpfModule.GetProgram(f.exit)
+		if err != nil {
+			return err
+		}
+		if _, err := enterProg.AttachUprobe(pid, path, f.off); err != nil {
+			return fmt.Errorf("failed to attach %s: %w", f.name, err)
+		}
+		if _, err := exitProg.AttachURetprobe(pid, path, f.off); err != nil {
+			return fmt.Errorf("failed to attach %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// attachLibs attaches to every path of lib, skipping the ones which do not
+// define its functions, unless the path is given by the user.
+func attachLibs(bpfModule *bpf.Module, lib sslLib, paths []string, userPath bool) int {
+	var attached int
+	for _, path := range paths {
+		err := attachLib(bpfModule, lib, path)
+		if errors.Is(err, errNoSymbol) && !userPath {
+			log.Printf("%s, skipped", err)
+			continue
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		attached++
+	}
+	return attached
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	var attached int
+	if !opts.noOpenSSL {
+		if opts.sslLib != "" {
+			attached += attachLibs(bpfModule, openSSL, []string{opts.sslLib}, true)
+		} else {
+			attached += attachLibs(bpfModule, openSSL, libPaths(openSSL.lib), false)
+		}
+	}
+	if !opts.noGnuTLS {
+		attached += attachLibs(bpfModule, gnuTLS, libPaths(gnuTLS.lib), false)
+	}
+	if attached == 0 {
+		log.Fatalln("no TLS library is found, try --ssl-lib")
+	}
+}
+
+func printEvent(data []byte) {
+	var e EventHeader
+	headerSize := int(unsafe.Sizeof(e))
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	comm := common.GoString(e.Comm[:])
+	if opts.comm != "" && !strings.Contains(comm, opts.comm) {
+		return
+	}
+
+	var buf []byte
+	if e.BufFilled == 1 && len(data) > headerSize {
+		buf = data[headerSize:]
+		if len(buf) > int(e.Len) {
+			buf = buf[:e.Len]
+		}
+	}
+	if len(buf) > int(opts.maxBufferSize) {
+		buf = buf[:opts.maxBufferSize]
+	}
+
+	if startTs == 0 {
+		startTs = e.TimestampNs
+	}
+	rw := "READ/RECV"
+	if e.Rw == SSL_WRITE {
+		rw = "WRITE/SEND"
+	}
+	fmt.Printf("%-12s %-18.9f %-16s %-7d %-7d ",
+		rw, float64(e.TimestampNs-startTs)/1e9, comm, e.Pid, e.Len)
+	if opts.latency {
+		fmt.Printf("%-7.3f ", float64(e.DeltaNs)/1e6)
+	}
+	fmt.Printf("\n")
+
+	fmt.Printf("----- DATA -----\n")
+	if opts.hexdump {
+		fmt.Print(hex.Dump(buf))
+	} else {
+		fmt.Printf("%s\n", strings.ToValidUTF8(string(buf), "\uFFFD"))
+	}
+	if lost := int(e.Len) - len(buf); lost > 0 {
+		fmt.Printf("----- END DATA (TRUNCATED, %d bytes lost) -----\n", lost)
+	} else {
+		fmt.Printf("----- END DATA -----\n")
+	}
+	fmt.Printf("\n")
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("perf_SSL_events", eventsChannel, lostChannel, 64)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	fmt.Printf("%-12s %-18s %-16s %-7s %-7s", "FUNC", "TIME(s)", "COMM", "PID", "LEN")
+	if opts.latency {
+		fmt.Printf(" %-7s", "LAT(ms)")
+	}
+	fmt.Printf("\n")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_endian.h>
+#include "tcpdrop.h"
+
+#define AF_INET		2
+#define AF_INET6	10
+#define ETH_P_IP	0x0800
+#define ETH_P_IPV6	0x86DD
+#define IPPROTO_TCP	6
+#define TCP_FLAGS_OFF	13
+
+const volatile bool do_count = false;
+const volatile __u16 target_family = 0;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_STACK_TRACE);
+	__type(key, u32);
+} stackmap SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u32);
+	__type(value, u64);
+} counts SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} events SEC(".maps");
+
+static int handle_drop(void *ctx, struct sk_buff *skb, u16 protocol, u32 reason)
+{
+	struct event e = {};
+	unsigned char *head;
+	u16 network_header, transport_header;
+	struct tcphdr *tcp;
+	struct sock *sk;
+	u8 ihl, l4proto;
+	u64 *count;
+	static const u64 zero;
+
+	head = BPF_CORE_READ(skb, head);
+	network_header = BPF_CORE_READ(skb, network_header);
+	transport_header = BPF_CORE_READ(skb, transport_header);
+	if (!head || network_header == (u16)~0U)
+		return 0;
+
+	if (protocol == ETH_P_IP) {
+		struct iphdr *ip = (struct iphdr *)(head + network_header);
+
+		bpf_probe_read_kernel(&ihl, sizeof(ihl), ip);
+		bpf_probe_read_kernel(&l4proto, sizeof(l4proto), &ip->protocol);
+		if (l4proto != IPPROTO_TCP)
+			return 0;
+		e.family = AF_INET;
+		bpf_probe_read_kernel(e.saddr, 4, &ip->saddr);
+		bpf_probe_read_kernel(e.daddr, 4, &ip->daddr);
+		/* the transport header is not set yet early on the receive path */
+		if (transport_header == (u16)~0U || transport_header == network_header)
+			transport_header = network_header + (ihl & 0x0f) * 4;
+	} else if (protocol == ETH_P_IPV6) {
+		struct ipv6hdr *ip6 = (struct ipv6hdr *)(head + network_header);
+
+		bpf_probe_read_kernel(&l4proto, sizeof(l4proto), &ip6->nexthdr);
+		if (l4proto != IPPROTO_TCP)
+			return 0;
+		e.family = AF_INET6;
+		bpf_probe_read_kernel(e.saddr, 16, &ip6->saddr);
+		bpf_probe_read_kernel(e.daddr, 16, &ip6->daddr);
+		if (transport_header == (u16)~0U || transport_header == network_header)
+			transport_header = network_header + sizeof(struct ipv6hdr);
+	} else {
+		return 0;
+	}
+
+	if (target_family && target_family != e.family)
+		return 0;
+
+	if (do_count) {
+		count = bpf_map_lookup_elem(&counts, &reason);
+		if (!count) {
+			bpf_map_update_elem(&counts, &reason, &zero, BPF_NOEXIST);
+			count = bpf_map_lookup_elem(&counts, &reason);
+			if (!count)
+				return 0;
+		}
+		__sync_fetch_and_add(count, 1);
+		return 0;
+	}
+
+	tcp = (struct tcphdr *)(head + transport_header);
+	e.sport = bpf_ntohs(BPF_CORE_READ(tcp, source));
+	e.dport = bpf_ntohs(BPF_CORE_READ(tcp, dest));
+	bpf_probe_read_kernel(&e.tcpflags, sizeof(e.tcpflags), (void *)tcp + TCP_FLAGS_OFF);
+
+	sk = BPF_CORE_READ(skb, sk);
+	if (sk)
+		e.state = BPF_CORE_READ(sk, __sk_common.skc_state);
+	e.reason = reason;
+	e.pid = bpf_get_current_pid_tgid() >> 32;
+	e.kern_stack_id = bpf_get_stackid(ctx, &stackmap, 0);
+	bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+	return 0;
+}
+
+SEC("tracepoint/skb/kfree_skb")
+int kfree_skb(struct trace_event_raw_kfree_skb *ctx)
+{
+	u32 reason = 0;
+
+	/* the drop reason is available since kernel 5.17 */
+	if (bpf_core_field_exists(ctx->reason))
+		reason = ctx->reason;
+	return handle_drop(ctx, (struct sk_buff *)ctx->skbaddr, ctx->protocol, reason);
+}
+
+SEC("kprobe/tcp_drop")
+int BPF_KPROBE(tcp_drop, struct sock *sk, struct sk_buff *skb)
+{
+	return handle_drop(ctx, skb, bpf_ntohs(BPF_CORE_READ(skb, protocol)), 0);
+}
+
+char LICENSE[] SEC("license") = "GPL";
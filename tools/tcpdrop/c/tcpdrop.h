@@ -0,0 +1,20 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __TCPDROP_H
+#define __TCPDROP_H
+
+#define MAX_ENTRIES 10240
+
+struct event {
+	__u8 saddr[16];
+	__u8 daddr[16];
+	__u32 pid;
+	__u32 reason;
+	__s32 kern_stack_id;
+	__u16 family;
+	__u16 sport;
+	__u16 dport;
+	__u8 state;
+	__u8 tcpflags;
+};
+
+#endif /* __TCPDROP_H */
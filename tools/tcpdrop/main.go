@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const dropReasonPrefix = "SKB_DROP_REASON_"
+
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+type Event struct {
+	Saddr       [16]byte
+	Daddr       [16]byte
+	Pid         uint32
+	Reason      uint32
+	KernStackId int32
+	Family      uint16
+	Sport       uint16
+	Dport       uint16
+	State       uint8
+	Tcpflags    uint8
+}
+
+type ReasonCount struct {
+	Reason uint32
+	Count  uint64
+}
+
+type Options struct {
+	bpfObjPath        string
+	verbose           bool
+	ipv4              bool
+	ipv6              bool
+	summary           bool
+	perfMaxStackDepth uint32
+	stackStorageSize  uint32
+}
+
+var opts = Options{
+	bpfObjPath:        "tcpdrop.bpf.o",
+	verbose:           false,
+	ipv4:              false,
+	ipv6:              false,
+	summary:           false,
+	perfMaxStackDepth: 127,
+	stackStorageSize:  1024,
+}
+
+// useTcpDrop is set on kernels whose kfree_skb tracepoint has no drop
+// reason, where tcp_drop is traced instead if it exists.
+var useTcpDrop bool
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.ipv4, "ipv4", "4", opts.ipv4, "Trace IPv4 family only")
+	flag.BoolVarP(&opts.ipv6, "ipv6", "6", opts.ipv6, "Trace IPv6 family only")
+	flag.BoolVarP(&opts.summary, "summary", "s", opts.summary, "Count drops by reason and print a summary at exit")
+	flag.Uint32Var(&opts.perfMaxStackDepth, "perf-max-stack-depth", opts.perfMaxStackDepth, "The limit for both kernel and user stack traces")
+	flag.Uint32Var(&opts.stackStorageSize, "stack-storage-size", opts.stackStorageSize, "The number of unique stack traces that can be stored and displayed")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.ipv4 && opts.ipv6 {
+		log.Fatalln("ipv4, ipv6 cann't be used together")
+	}
+}
+
+// dropReasons returns the names of enum skb_drop_reason, and whether the
+// kfree_skb tracepoint reports it.
+func dropReasons() (map[uint32]string, bool) {
+	names := map[uint32]string{}
+	btf, err := common.LoadVmlinuxBTF()
+	if err != nil {
+		return names, false
+	}
+	if id, err := btf.FindByName("skb_drop_reason", common.BTF_KIND_ENUM); err == nil {
+		for _, v := range btf.TypeByID(id).EnumValues {
+			names[uint32(v.Value)] = strings.TrimPrefix(v.Name, dropReasonPrefix)
+		}
+	}
+	id, err := btf.FindByName("trace_event_raw_kfree_skb", common.BTF_KIND_STRUCT)
+	if err != nil {
+		return names, false
+	}
+	if _, err := btf.FindMember(id, "reason"); err != nil {
+		return names, false
+	}
+	return names, true
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.summary {
+		if err := bpfModule.InitGlobalVariable("do_count", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	family := uint16(0)
+	if opts.ipv4 {
+		family = common.AF_INET
+	} else if opts.ipv6 {
+		family = common.AF_INET6
+	}
+	if family != 0 {
+		if err := bpfModule.InitGlobalVariable("target_family", family); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.SetValueSize(opts.perfMaxStackDepth * 8); err != nil {
+		log.Fatalln(err)
+	}
+	if err := stackmap.Resize(opts.stackStorageSize); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) {
+	disabled := "tcp_drop"
+	if useTcpDrop {
+		disabled = "kfree_skb"
+	}
+	prog, err := bpfModule.GetProgram(disabled)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := prog.SetAutoload(false); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if (prog.Name() == "kfree_skb") == useTcpDrop {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func reasonName(reasons map[uint32]string, reason uint32) string {
+	if name, ok := reasons[reason]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+func tcpFlags(flags uint8) string {
+	var names []string
+	for i, name := range tcpFlagNames {
+		if flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "|")
+}
+
+func getStack(stackmap *bpf.BPFMap, stackId int32) []uint64 {
+	if stackId < 0 {
+		return nil
+	}
+	rawStack, err := stackmap.GetValue(unsafe.Pointer(&stackId))
+	if err != nil {
+		return nil
+	}
+	var stack []uint64
+	for i := 0; i+8 <= len(rawStack); i += 8 {
+		addr := binary.LittleEndian.Uint64(rawStack[i : i+8])
+		if addr == 0 {
+			break
+		}
+		stack = append(stack, addr)
+	}
+	return stack
+}
+
+func printEvent(data []byte, stackmap *bpf.BPFMap, ksyms *common.Ksyms, reasons map[uint32]string) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	ts := time.Now().Format("15:04:05")
+	ipVersion := 4
+	if e.Family == common.AF_INET6 {
+		ipVersion = 6
+	}
+	saddr := netip.AddrPortFrom(common.AddrFrom16(e.Family, e.Saddr), e.Sport)
+	daddr := netip.AddrPortFrom(common.AddrFrom16(e.Family, e.Daddr), e.Dport)
+	/* packets dropped before the socket lookup have no state */
+	state := "-"
+	if e.State != 0 {
+		state = common.TCPStateName(int(e.State))
+	}
+	reason := "-"
+	if !useTcpDrop {
+		reason = reasonName(reasons, e.Reason)
+	}
+	fmt.Printf("%-8s %-7d %-2d %-20s > %-20s %-12s %-16s %s\n",
+		ts, e.Pid, ipVersion, saddr, daddr, state, tcpFlags(e.Tcpflags), reason)
+
+	stack := getStack(stackmap, e.KernStackId)
+	if stack == nil {
+		fmt.Printf("\t[Missed Kernel Stack]\n")
+	}
+	for _, addr := range stack {
+		if k := ksyms.MapAddr(addr); k != nil {
+			fmt.Printf("\t%s+%#x\n", k.Name, addr-k.Addr)
+		} else {
+			fmt.Printf("\t%#x\n", addr)
+		}
+	}
+	fmt.Printf("\n")
+}
+
+func printSummary(counts *bpf.BPFMap, reasons map[uint32]string) {
+	items, err := common.DumpHash(counts)
+	if err != nil {
+		log.Fatalf("failed to dump counts: %s", err)
+	}
+	var rows []ReasonCount
+	for _, item := range items {
+		rows = append(rows, ReasonCount{
+			Reason: binary.LittleEndian.Uint32(item[0]),
+			Count:  binary.LittleEndian.Uint64(item[1]),
+		})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Count > rows[j].Count
+	})
+
+	fmt.Printf("\n%-32s %s\n", "REASON", "DROPS")
+	for _, row := range rows {
+		reason := "-"
+		if !useTcpDrop {
+			reason = reasonName(reasons, row.Reason)
+		}
+		fmt.Printf("%-32s %d\n", reason, row.Count)
+	}
+}
+
+func main() {
+	parseArgs()
+
+	reasons, hasReason := dropReasons()
+	if !hasReason && common.KprobeExists("tcp_drop") {
+		useTcpDrop = true
+	}
+
+	ksyms, err := common.LoadKsyms()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.summary {
+		counts, err := bpfModule.GetMap("counts")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Tracing tcp drops ... Hit Ctrl-C to end\n")
+		<-ctx.Done()
+		printSummary(counts, reasons)
+		return
+	}
+
+	stackmap, err := bpfModule.GetMap("stackmap")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	defer func() {
+		pb.Stop()
+		pb.Close()
+	}()
+
+	fmt.Printf("Tracing tcp drops ... Hit Ctrl-C to end\n")
+	fmt.Printf("%-8s %-7s %-2s %-20s > %-20s %-12s %-16s %s\n",
+		"TIME", "PID", "IP", "SADDR:SPORT", "DADDR:DPORT", "STATE", "FLAGS", "REASON")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data, stackmap, ksyms, reasons)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_tracing.h>
+#include <bpf/bpf_endian.h>
+#include "tcpretrans.h"
+
+#define AF_INET		2
+#define AF_INET6	10
+
+const volatile bool do_count = false;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, struct flow_key);
+	__type(value, u64);
+} counts SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} events SEC(".maps");
+
+static int handle_event(void *ctx, struct event *e)
+{
+	static const u64 zero;
+	u64 *count;
+
+	if (!do_count) {
+		e->pid = bpf_get_current_pid_tgid() >> 32;
+		bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, e, sizeof(*e));
+		return 0;
+	}
+
+	count = bpf_map_lookup_elem(&counts, &e->key);
+	if (!count) {
+		bpf_map_update_elem(&counts, &e->key, &zero, BPF_NOEXIST);
+		count = bpf_map_lookup_elem(&counts, &e->key);
+		if (!count)
+			return 0;
+	}
+	__sync_fetch_and_add(count, 1);
+	return 0;
+}
+
+SEC("tracepoint/tcp/tcp_retransmit_skb")
+int tcp_retransmit_skb(struct trace_event_raw_tcp_event_sk_skb *ctx)
+{
+	struct event e = {};
+
+	e.type = RETRANSMIT;
+	e.state = ctx->state;
+	e.key.family = ctx->family;
+	e.key.sport = ctx->sport;
+	e.key.dport = ctx->dport;
+	if (e.key.family == AF_INET) {
+		bpf_probe_read_kernel(e.key.saddr, 4, ctx->saddr);
+		bpf_probe_read_kernel(e.key.daddr, 4, ctx->daddr);
+	} else if (e.key.family == AF_INET6) {
+		bpf_probe_read_kernel(e.key.saddr, 16, ctx->saddr_v6);
+		bpf_probe_read_kernel(e.key.daddr, 16, ctx->daddr_v6);
+	} else {
+		return 0;
+	}
+
+	return handle_event(ctx, &e);
+}
+
+SEC("kprobe/tcp_send_loss_probe")
+int BPF_KPROBE(tcp_send_loss_probe, struct sock *sk)
+{
+	struct event e = {};
+
+	e.type = TLP;
+	e.state = BPF_CORE_READ(sk, __sk_common.skc_state);
+	e.key.family = BPF_CORE_READ(sk, __sk_common.skc_family);
+	e.key.sport = BPF_CORE_READ(sk, __sk_common.skc_num);
+	e.key.dport = bpf_ntohs(BPF_CORE_READ(sk, __sk_common.skc_dport));
+	if (e.key.family == AF_INET) {
+		bpf_core_read(e.key.saddr, 4, &sk->__sk_common.skc_rcv_saddr);
+		bpf_core_read(e.key.daddr, 4, &sk->__sk_common.skc_daddr);
+	} else if (e.key.family == AF_INET6) {
+		bpf_core_read(e.key.saddr, 16, &sk->__sk_common.skc_v6_rcv_saddr);
+		bpf_core_read(e.key.daddr, 16, &sk->__sk_common.skc_v6_daddr);
+	} else {
+		return 0;
+	}
+
+	return handle_event(ctx, &e);
+}
+
+char LICENSE[] SEC("license") = "GPL";
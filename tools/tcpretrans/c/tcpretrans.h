@@ -0,0 +1,27 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __TCPRETRANS_H
+#define __TCPRETRANS_H
+
+#define MAX_ENTRIES 10240
+
+enum retrans_type {
+	RETRANSMIT = 1,
+	TLP,
+};
+
+struct flow_key {
+	__u8 saddr[16];
+	__u8 daddr[16];
+	__u16 family;
+	__u16 sport;
+	__u16 dport;
+};
+
+struct event {
+	struct flow_key key;
+	__u32 pid;
+	__u32 state;
+	__u32 type;
+};
+
+#endif /* __TCPRETRANS_H */
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	RETRANSMIT = iota + 1
+	TLP
+)
+
+type FlowKey struct {
+	Saddr  common.Uint128
+	Daddr  common.Uint128
+	Family uint16
+	Sport  uint16
+	Dport  uint16
+}
+
+type Event struct {
+	Key   FlowKey
+	_     [2]byte
+	Pid   uint32
+	State uint32
+	Type  uint32
+}
+
+type FlowCount struct {
+	Key   FlowKey
+	Count uint64
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	lossprobe  bool
+	count      bool
+}
+
+var opts = Options{
+	bpfObjPath: "tcpretrans.bpf.o",
+	verbose:    false,
+	lossprobe:  false,
+	count:      false,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.lossprobe, "lossprobe", "l", opts.lossprobe, "Include tail loss probe attempts")
+	flag.BoolVarP(&opts.count, "count", "c", opts.count, "Count occurred retransmits per flow")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.count {
+		if err := bpfModule.InitGlobalVariable("do_count", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) {
+	if opts.lossprobe {
+		return
+	}
+	prog, err := bpfModule.GetProgram("tcp_send_loss_probe")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := prog.SetAutoload(false); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if prog.Name() == "tcp_send_loss_probe" && !opts.lossprobe {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func (k FlowKey) endpoints() (string, string) {
+	local := netip.AddrPortFrom(common.AddrFrom16(k.Family, k.Saddr), k.Sport)
+	remote := netip.AddrPortFrom(common.AddrFrom16(k.Family, k.Daddr), k.Dport)
+	return local.String(), remote.String()
+}
+
+func (k FlowKey) ipVersion() int {
+	if k.Family == common.AF_INET6 {
+		return 6
+	}
+	return 4
+}
+
+func printEvent(data []byte) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	ts := time.Now().Format("15:04:05")
+	typ := "R>"
+	if e.Type == TLP {
+		typ = "L>"
+	}
+	local, remote := e.Key.endpoints()
+	fmt.Printf("%-8s %-7d %-2d %-20s %s %-20s %s\n",
+		ts, e.Pid, e.Key.ipVersion(), local, typ, remote, common.TCPStateName(int(e.State)))
+}
+
+func printCounts(counts *bpf.BPFMap) {
+	items, err := common.DumpHash(counts)
+	if err != nil {
+		log.Fatalf("failed to dump counts: %s", err)
+	}
+	var flows []FlowCount
+	for _, item := range items {
+		var flow FlowCount
+		if err := binary.Read(bytes.NewReader(item[0]), binary.LittleEndian, &flow.Key); err != nil {
+			log.Fatalln(err)
+		}
+		flow.Count = binary.LittleEndian.Uint64(item[1])
+		flows = append(flows, flow)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].Count > flows[j].Count
+	})
+
+	fmt.Printf("\n%-25s    %-25s %-10s\n", "LADDR:LPORT", "RADDR:RPORT", "RETRANSMITS")
+	for _, flow := range flows {
+		local, remote := flow.Key.endpoints()
+		fmt.Printf("%-25s <-> %-25s %-10d\n", local, remote, flow.Count)
+	}
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.count {
+		counts, err := bpfModule.GetMap("counts")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("Tracing retransmits ... Hit Ctrl-C to end\n")
+		<-ctx.Done()
+		printCounts(counts)
+		return
+	}
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	defer func() {
+		pb.Stop()
+		pb.Close()
+	}()
+
+	fmt.Printf("Tracing retransmits ... Hit Ctrl-C to end\n")
+	fmt.Printf("%-8s %-7s %-2s %-20s %-2s %-20s %s\n",
+		"TIME", "PID", "IP", "LADDR:LPORT", "T>", "RADDR:RPORT", "STATE")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
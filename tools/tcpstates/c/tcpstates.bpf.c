@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/tcpstates.bpf.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/tcpstates.c
\ No newline at end of file
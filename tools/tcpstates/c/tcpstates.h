@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/tcpstates.h
\ No newline at end of file
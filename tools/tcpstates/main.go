@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const TASK_COMM_LEN = 16
+
+var columnWidth = 15
+
+type Event struct {
+	Saddr    common.Uint128
+	Daddr    common.Uint128
+	Skaddr   uint64
+	TsUs     uint64
+	DeltaUs  uint64
+	Pid      uint32
+	Oldstate int32
+	Newstate int32
+	Family   uint16
+	Sport    uint16
+	Dport    uint16
+	Task     [TASK_COMM_LEN]byte
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	timestamp  bool
+	ipv4       bool
+	ipv6       bool
+	wide       bool
+	localport  []uint
+	remoteport []uint
+}
+
+var opts = Options{
+	bpfObjPath: "tcpstates.bpf.o",
+	verbose:    false,
+	timestamp:  false,
+	ipv4:       false,
+	ipv6:       false,
+	wide:       false,
+	localport:  nil,
+	remoteport: nil,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Include timestamp on output")
+	flag.BoolVarP(&opts.ipv4, "ipv4", "4", opts.ipv4, "Trace IPv4 family only")
+	flag.BoolVarP(&opts.ipv6, "ipv6", "6", opts.ipv6, "Trace IPv6 family only")
+	flag.BoolVarP(&opts.wide, "wide", "w", opts.wide, "Wide column output (fits IPv6 addresses)")
+	flag.UintSliceVarP(&opts.localport, "localport", "L", opts.localport, "Comma-separated list of local ports to trace")
+	flag.UintSliceVarP(&opts.remoteport, "remoteport", "D", opts.remoteport, "Comma-separated list of remote ports to trace")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.ipv4 && opts.ipv6 {
+		log.Fatalln("use either -4 or -6")
+	}
+	for _, v := range append(opts.localport, opts.remoteport...) {
+		if v == 0 || v > 65535 {
+			log.Fatalf("invalid port: %d\n", v)
+		}
+	}
+	if opts.wide {
+		columnWidth = 39
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	var targetFamily int16
+	if opts.ipv4 {
+		targetFamily = common.AF_INET
+	}
+	if opts.ipv6 {
+		targetFamily = common.AF_INET6
+	}
+	if targetFamily > 0 {
+		if err := bpfModule.InitGlobalVariable("target_family", targetFamily); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(opts.localport) > 0 {
+		if err := bpfModule.InitGlobalVariable("filter_by_sport", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(opts.remoteport) > 0 {
+		if err := bpfModule.InitGlobalVariable("filter_by_dport", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func updatePortsMap(bpfModule *bpf.Module, mapName string, ports []uint) {
+	portsMap, err := bpfModule.GetMap(mapName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, v := range ports {
+		port := uint16(v)
+		if err := portsMap.Update(unsafe.Pointer(&port), unsafe.Pointer(&port)); err != nil {
+			log.Fatalf("failed to update %s: %s", mapName, err)
+		}
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+	if len(opts.localport) > 0 {
+		updatePortsMap(bpfModule, "sports", opts.localport)
+	}
+	if len(opts.remoteport) > 0 {
+		updatePortsMap(bpfModule, "dports", opts.remoteport)
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func printHeader() {
+	if opts.timestamp {
+		fmt.Printf("%-8s ", "TIME(s)")
+	}
+	fmt.Printf("%-16s %-7s %-16s %-2s %-*s %-5s %-*s %-5s %-11s -> %-11s %s\n",
+		"SKADDR", "PID", "COMM", "IP", columnWidth, "LADDR", "LPORT",
+		columnWidth, "RADDR", "RPORT", "OLDSTATE", "NEWSTATE", "MS")
+}
+
+func printEvent(data []byte) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+
+	if opts.timestamp {
+		ts := time.Now().Format("15:04:05")
+		fmt.Printf("%8s ", ts)
+	}
+	ipVersion := 4
+	if e.Family == common.AF_INET6 {
+		ipVersion = 6
+	}
+	fmt.Printf("%-16x %-7d %-16s %-2d %-*s %-5d %-*s %-5d %-11s -> %-11s %.3f\n",
+		e.Skaddr, e.Pid, common.GoString(e.Task[:]), ipVersion,
+		columnWidth, common.AddrFrom16(e.Family, e.Saddr).String(), e.Sport,
+		columnWidth, common.AddrFrom16(e.Family, e.Daddr).String(), e.Dport,
+		common.TCPStateName(int(e.Oldstate)), common.TCPStateName(int(e.Newstate)),
+		float64(e.DeltaUs)/1000)
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	printHeader()
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/tcptop.bpf.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/tcptop.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/tcptop.h
\ No newline at end of file
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+	"unsafe"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	TASK_COMM_LEN     = 16
+	OUTPUT_ROWS_LIMIT = 10240
+)
+
+const (
+	ALL = iota
+	SENT
+	RECEIVED
+)
+
+type IPKey struct {
+	Saddr  common.Uint128
+	Daddr  common.Uint128
+	Pid    uint32
+	Name   [TASK_COMM_LEN]byte
+	Lport  uint16
+	Dport  uint16
+	Family uint16
+}
+
+type Traffic struct {
+	Sent     uint64
+	Received uint64
+}
+
+type IPStat struct {
+	Key   IPKey
+	Value Traffic
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	cgroup     string
+	ipv4       bool
+	ipv6       bool
+	noclear    bool
+	nosummary  bool
+	sort       string
+	rows       uint
+	interval   uint64
+	count      uint64
+	sortBy     int
+}
+
+var opts = Options{
+	bpfObjPath: "tcptop.bpf.o",
+	verbose:    false,
+	pid:        -1,
+	cgroup:     "",
+	ipv4:       false,
+	ipv6:       false,
+	noclear:    false,
+	nosummary:  false,
+	sort:       "all",
+	rows:       20,
+	interval:   1,
+	count:      99999999,
+	sortBy:     0,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Process ID to trace")
+	flag.StringVarP(&opts.cgroup, "cgroup", "c", opts.cgroup, "Trace process in cgroup path")
+	flag.BoolVarP(&opts.ipv4, "ipv4", "4", opts.ipv4, "Trace IPv4 family only")
+	flag.BoolVarP(&opts.ipv6, "ipv6", "6", opts.ipv6, "Trace IPv6 family only")
+	flag.BoolVarP(&opts.noclear, "noclear", "C", opts.noclear, "Don't clear the screen")
+	flag.BoolVarP(&opts.nosummary, "nosummary", "S", opts.nosummary, "Skip system summary line")
+	flag.StringVarP(&opts.sort, "sort", "s", opts.sort, "Sort columns, default all [all, sent, received]")
+	flag.UintVarP(&opts.rows, "rows", "r", opts.rows, "Maximum rows to print, default 20")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if opts.ipv4 && opts.ipv6 {
+		log.Fatalln("use either -4 or -6")
+	}
+	switch opts.sort {
+	case "sent":
+		opts.sortBy = SENT
+	case "received":
+		opts.sortBy = RECEIVED
+	default:
+		opts.sortBy = ALL
+	}
+	if opts.rows > OUTPUT_ROWS_LIMIT {
+		opts.rows = OUTPUT_ROWS_LIMIT
+	}
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.count = uint64(count)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid >= 0 {
+		if err := bpfModule.InitGlobalVariable("target_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var targetFamily int32 = -1
+	if opts.ipv4 {
+		targetFamily = common.AF_INET
+	}
+	if opts.ipv6 {
+		targetFamily = common.AF_INET6
+	}
+	if targetFamily > 0 {
+		if err := bpfModule.InitGlobalVariable("target_family", targetFamily); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.cgroup != "" {
+		if err := bpfModule.InitGlobalVariable("filter_cg", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+	if opts.cgroup != "" {
+		idx := 0
+		cgroupFd, err := common.GetCgroupDirFD(opts.cgroup)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cgroupMap, err := bpfModule.GetMap("cgroup_map")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := cgroupMap.Update(unsafe.Pointer(&idx), unsafe.Pointer(&cgroupFd)); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func sortColumn(values []IPStat) {
+	sort.Slice(values, func(i, j int) bool {
+		switch opts.sortBy {
+		case SENT:
+			return values[i].Value.Sent > values[j].Value.Sent
+		case RECEIVED:
+			return values[i].Value.Received > values[j].Value.Received
+		default:
+			return (values[i].Value.Sent + values[i].Value.Received) >
+				(values[j].Value.Sent + values[j].Value.Received)
+		}
+	})
+}
+
+func printSection(values []IPStat, addrWidth int) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Printf("%-7s %-16s %-*s %-*s %6s %6s\n",
+		"PID", "COMM", addrWidth, "LADDR", addrWidth, "RADDR", "RX_KB", "TX_KB")
+
+	sortColumn(values)
+	rows := len(values)
+	if rows > int(opts.rows) {
+		rows = int(opts.rows)
+	}
+	for i := 0; i < rows; i++ {
+		key := values[i].Key
+		laddr := fmt.Sprintf("%s:%d", common.AddrFrom16(key.Family, key.Saddr), key.Lport)
+		raddr := fmt.Sprintf("%s:%d", common.AddrFrom16(key.Family, key.Daddr), key.Dport)
+		fmt.Printf("%-7d %-16s %-*s %-*s %6d %6d\n",
+			key.Pid, common.GoString(key.Name[:]), addrWidth, laddr, addrWidth, raddr,
+			values[i].Value.Received/1024, values[i].Value.Sent/1024)
+	}
+	fmt.Printf("\n")
+}
+
+func printStat(ipMap *bpf.BPFMap) {
+	if !opts.nosummary {
+		loadData, _ := os.ReadFile("/proc/loadavg")
+		if len(loadData) > 0 {
+			ts := time.Now().Format("15:04:05")
+			load := string(bytes.TrimSpace(loadData))
+			if load != "" {
+				fmt.Printf("%8s loadavg: %s\n\n", ts, load)
+			}
+		}
+	}
+
+	items, err := common.DumpThenClearHash(ipMap)
+	if err != nil {
+		log.Fatalf("failed to dump ip_map: %s", err)
+	}
+	var ipv4Values, ipv6Values []IPStat
+	for _, item := range items {
+		var stat IPStat
+		if err := binary.Read(bytes.NewReader(item[0]), binary.LittleEndian, &stat.Key); err != nil {
+			log.Fatalln(err)
+		}
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &stat.Value); err != nil {
+			log.Fatalln(err)
+		}
+		if stat.Key.Family == common.AF_INET6 {
+			ipv6Values = append(ipv6Values, stat)
+		} else {
+			ipv4Values = append(ipv4Values, stat)
+		}
+	}
+
+	printSection(ipv4Values, 21)
+	printSection(ipv6Values, 51)
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	ipMap, err := bpfModule.GetMap("ip_map")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	err = common.RunTopLoop(common.TopLoopOptions{
+		Interval: opts.interval,
+		Count:    opts.count,
+		NoClear:  opts.noclear,
+	}, func() {
+		printStat(ipMap)
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
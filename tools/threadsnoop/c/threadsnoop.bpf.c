@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "threadsnoop.h"
+
+const volatile pid_t targ_pid = 0;
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} events SEC(".maps");
+
+SEC("uprobe")
+int BPF_UPROBE(pthread_create, void *thread, const void *attr, void *start_routine, void *arg)
+{
+	u64 pid_tgid = bpf_get_current_pid_tgid();
+	struct event e = {};
+
+	e.pid = pid_tgid >> 32;
+	if (targ_pid && targ_pid != e.pid)
+		return 0;
+
+	e.tid = (u32)pid_tgid;
+	e.ts = bpf_ktime_get_ns();
+	e.start_routine = (u64)start_routine;
+	bpf_get_current_comm(&e.comm, sizeof(e.comm));
+	bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, &e, sizeof(e));
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
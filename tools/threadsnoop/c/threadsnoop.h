@@ -0,0 +1,15 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __THREADSNOOP_H
+#define __THREADSNOOP_H
+
+#define TASK_COMM_LEN	16
+
+struct event {
+	__u64 ts;
+	__u64 start_routine;
+	__u32 pid;
+	__u32 tid;
+	char comm[TASK_COMM_LEN];
+};
+
+#endif /* __THREADSNOOP_H */
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/aquasecurity/libbpfgo/helpers"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const TASK_COMM_LEN = 16
+
+type Event struct {
+	Ts           uint64
+	StartRoutine uint64
+	Pid          uint32
+	Tid          uint32
+	Comm         [TASK_COMM_LEN]byte
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	pid        int32
+	libc       string
+}
+
+var opts = Options{
+	bpfObjPath: "threadsnoop.bpf.o",
+	verbose:    false,
+	pid:        0,
+	libc:       "",
+}
+
+var startTs uint64
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.Int32VarP(&opts.pid, "pid", "p", opts.pid, "Process ID to trace")
+	flag.StringVarP(&opts.libc, "libc", "l", opts.libc, "Specify which libc.so to use")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.pid > 0 {
+		if err := bpfModule.InitGlobalVariable("targ_pid", opts.pid); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+// findPthreadCreate returns the library which defines pthread_create and
+// its offset. It is in libc since glibc 2.34, and in libpthread before.
+// Without a pid the libraries used by the system are searched, as the tool
+// itself is linked statically.
+func findPthreadCreate() (string, uint32) {
+	if opts.libc != "" {
+		funcOff, err := helpers.SymbolToOffset(opts.libc, "pthread_create")
+		if err != nil || funcOff <= 0 {
+			log.Fatalf("could not find pthread_create in %s\n", opts.libc)
+		}
+		return opts.libc, funcOff
+	}
+	for _, lib := range []string{"c", "pthread"} {
+		path, err := common.GetPidLibPath(int(opts.pid), lib)
+		if err != nil {
+			continue
+		}
+		funcOff, err := helpers.SymbolToOffset(path, "pthread_create")
+		if err == nil && funcOff > 0 {
+			return path, funcOff
+		}
+	}
+	log.Fatalln("could not find pthread_create in libc.so or libpthread.so")
+	return "", 0
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	path, funcOff := findPthreadCreate()
+	pid := -1
+	if opts.pid > 0 {
+		pid = int(opts.pid)
+	}
+
+	prog, err := bpfModule.GetProgram("pthread_create")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := prog.AttachUprobe(pid, path, funcOff); err != nil {
+		log.Fatalf("failed to attach pthread_create: %s", err)
+	}
+}
+
+func startRoutineName(symsCache *common.SymsCache, pid int, addr uint64) string {
+	syms, err := symsCache.GetSyms(pid)
+	if err != nil {
+		return fmt.Sprintf("%#x", addr)
+	}
+	sym, dso, offset := syms.MapAddrDso(addr)
+	if sym != nil {
+		return sym.Name
+	}
+	if dso != "" {
+		return fmt.Sprintf("[%s+%#x]", dso, offset)
+	}
+	return fmt.Sprintf("%#x", addr)
+}
+
+func printEvent(data []byte, symsCache *common.SymsCache) {
+	var e Event
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	if startTs == 0 {
+		startTs = e.Ts
+	}
+	fmt.Printf("%-10d %-7d %-7d %-16s %s\n", (e.Ts-startTs)/1000000, e.Pid, e.Tid,
+		common.GoString(e.Comm[:]), startRoutineName(symsCache, int(e.Pid), e.StartRoutine))
+}
+
+func main() {
+	parseArgs()
+
+	symsCache := common.NewSymsCache()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 1)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	fmt.Printf("%-10s %-7s %-7s %-16s %s\n", "TIME(ms)", "PID", "TID", "COMM", "FUNC")
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data, symsCache)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
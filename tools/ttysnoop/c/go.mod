@@ -0,0 +1,3 @@
+module github.com/mozillazg/libbpfgo-tools/tools/ttysnoop/c
+
+go 1.17
@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_tracing.h>
+#include "ttysnoop.h"
+
+const volatile __u64 target_ino = 0;
+const volatile __u32 user_datasize = 256;
+const volatile __u32 user_datacount = 16;
+
+/* iov_iter of kernels since 6.0, which have user buffer iterators */
+enum iter_type___x {
+	ITER_UBUF___x,
+};
+
+struct iov_iter___x {
+	u8 iter_type;
+	void *ubuf;
+	const struct iovec *__iov;
+} __attribute__((preserve_access_index));
+
+/* iov_iter of kernels before 6.4 */
+struct iov_iter___y {
+	const struct iovec *iov;
+} __attribute__((preserve_access_index));
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, u32);
+	__type(value, struct event);
+} heap SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+	__uint(key_size, sizeof(u32));
+	__uint(value_size, sizeof(u32));
+} events SEC(".maps");
+
+static int do_tty_write(void *ctx, const char *buf, size_t count)
+{
+	u32 zero = 0;
+	struct event *e;
+	u32 i, n;
+
+	e = bpf_map_lookup_elem(&heap, &zero);
+	if (!e)
+		return 0;
+
+	e->ts = bpf_ktime_get_ns();
+	for (i = 0; i < MAX_DATACOUNT && i < user_datacount && count > 0; i++) {
+		n = count < user_datasize ? count : user_datasize;
+		if (n > MAX_DATASIZE)
+			n = MAX_DATASIZE;
+		if (bpf_probe_read_user(e->buf, n, buf))
+			return 0;
+		e->count = n;
+		bpf_perf_event_output(ctx, &events, BPF_F_CURRENT_CPU, e,
+				      sizeof(*e) - MAX_DATASIZE + n);
+		buf += n;
+		count -= n;
+	}
+	return 0;
+}
+
+static const struct iovec *first_iovec(struct iov_iter *from)
+{
+	struct iov_iter___x *it = (void *)from;
+
+	if (bpf_core_field_exists(it->__iov))
+		return BPF_CORE_READ(it, __iov);
+	return BPF_CORE_READ((struct iov_iter___y *)from, iov);
+}
+
+/* tty_write of kernels since 5.10 */
+SEC("kprobe/tty_write")
+int BPF_KPROBE(tty_write, struct kiocb *iocb, struct iov_iter *from)
+{
+	struct iov_iter___x *it = (void *)from;
+	const struct iovec *iov;
+	const char *buf;
+	size_t count;
+
+	if (BPF_CORE_READ(iocb, ki_filp, f_inode, i_ino) != target_ino)
+		return 0;
+
+	count = BPF_CORE_READ(from, count);
+	if (bpf_core_field_exists(it->ubuf) &&
+	    bpf_core_enum_value_exists(enum iter_type___x, ITER_UBUF___x) &&
+	    BPF_CORE_READ(it, iter_type) == bpf_core_enum_value(enum iter_type___x, ITER_UBUF___x)) {
+		buf = BPF_CORE_READ(it, ubuf);
+	} else {
+		/* only the first segment of a writev is captured */
+		iov = first_iovec(from);
+		buf = BPF_CORE_READ(iov, iov_base);
+		if (BPF_CORE_READ(iov, iov_len) < count)
+			count = BPF_CORE_READ(iov, iov_len);
+	}
+	return do_tty_write(ctx, buf, count);
+}
+
+/* tty_write of kernels before 5.10 */
+SEC("kprobe/tty_write")
+int BPF_KPROBE(tty_write_old, struct file *file, const char *buf, size_t count)
+{
+	if (BPF_CORE_READ(file, f_inode, i_ino) != target_ino)
+		return 0;
+	return do_tty_write(ctx, buf, count);
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,14 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __TTYSNOOP_H
+#define __TTYSNOOP_H
+
+#define MAX_DATASIZE	4096
+#define MAX_DATACOUNT	64
+
+struct event {
+	__u64 ts;
+	__u32 count;
+	char buf[MAX_DATASIZE];
+};
+
+#endif /* __TTYSNOOP_H */
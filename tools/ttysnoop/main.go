@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	MAX_DATASIZE  = 4096
+	MAX_DATACOUNT = 64
+)
+
+// EventHeader is struct event without the buffer, which is only sent as far
+// as it is filled.
+type EventHeader struct {
+	Ts    uint64
+	Count uint32
+}
+
+/* the buffer follows count directly, without padding */
+const eventHeaderSize = 12
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	noClear    bool
+	timestamp  bool
+	record     string
+	datasize   uint32
+	datacount  uint32
+	device     string
+}
+
+var opts = Options{
+	bpfObjPath: "ttysnoop.bpf.o",
+	verbose:    false,
+	noClear:    false,
+	timestamp:  false,
+	record:     "",
+	datasize:   256,
+	datacount:  16,
+	device:     "",
+}
+
+var out io.Writer = os.Stdout
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.noClear, "noclear", "C", opts.noClear, "Don't clear the screen")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Prefix each write with a timestamp")
+	flag.StringVarP(&opts.record, "record", "r", opts.record, "Also append the output to this file")
+	flag.Uint32VarP(&opts.datasize, "datasize", "s", opts.datasize, "Size of the transmit buffer")
+	flag.Uint32VarP(&opts.datacount, "datacount", "c", opts.datacount, "Number of times we check for data")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] DEVICE\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "DEVICE is a path like /dev/pts/1 or an inode number.\n\n")
+		flag.PrintDefaults()
+	}
+}
+
+func parseArgs() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	opts.device = flag.Arg(0)
+	if opts.datasize == 0 || opts.datasize > MAX_DATASIZE {
+		log.Fatalf("Invalid datasize, it should be in [1, %d]\n", MAX_DATASIZE)
+	}
+	if opts.datacount == 0 || opts.datacount > MAX_DATACOUNT {
+		log.Fatalf("Invalid datacount, it should be in [1, %d]\n", MAX_DATACOUNT)
+	}
+}
+
+// deviceInode returns the inode of the tty, which is given by its path or
+// directly as a number.
+func deviceInode(device string) (uint64, error) {
+	if !strings.HasPrefix(device, "/") {
+		ino, err := strconv.ParseUint(device, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid device %s: %w", device, err)
+		}
+		return ino, nil
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(device, &st); err != nil {
+		return 0, fmt.Errorf("failed to stat %s: %w", device, err)
+	}
+	return st.Ino, nil
+}
+
+// ttyWriteHasIter reports whether tty_write takes a kiocb and an iov_iter,
+// which it does since kernel 5.10.
+func ttyWriteHasIter() bool {
+	btf, err := common.LoadVmlinuxBTF()
+	if err != nil {
+		return true
+	}
+	id, err := btf.FindByName("tty_write", common.BTF_KIND_FUNC)
+	if err != nil {
+		return true
+	}
+	proto := btf.TypeByID(btf.TypeByID(id).Type)
+	return proto == nil || len(proto.Params) == 2
+}
+
+func initGlobalVars(bpfModule *bpf.Module, ino uint64) {
+	if err := bpfModule.InitGlobalVariable("target_ino", ino); err != nil {
+		log.Fatalln(err)
+	}
+	if err := bpfModule.InitGlobalVariable("user_datasize", opts.datasize); err != nil {
+		log.Fatalln(err)
+	}
+	if err := bpfModule.InitGlobalVariable("user_datacount", opts.datacount); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func setAutoload(bpfModule *bpf.Module) string {
+	enabled, disabled := "tty_write", "tty_write_old"
+	if !ttyWriteHasIter() {
+		enabled, disabled = disabled, enabled
+	}
+	prog, err := bpfModule.GetProgram(disabled)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := prog.SetAutoload(false); err != nil {
+		log.Fatalln(err)
+	}
+	return enabled
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module, name string) {
+	prog, err := bpfModule.GetProgram(name)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if _, err := prog.AttachGeneric(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func printEvent(data []byte) {
+	var e EventHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &e); err != nil {
+		log.Fatalf("read data failed: %s\n%v", err, data)
+	}
+	buf := data[eventHeaderSize:]
+	if len(buf) > int(e.Count) {
+		buf = buf[:e.Count]
+	}
+	if opts.timestamp {
+		fmt.Fprintf(out, "[%s] ", time.Now().Format("15:04:05.000"))
+	}
+	out.Write(buf)
+}
+
+func main() {
+	parseArgs()
+
+	ino, err := deviceInode(opts.device)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if opts.record != "" {
+		f, err := os.OpenFile(opts.record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		out = io.MultiWriter(os.Stdout, f)
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule, ino)
+	name := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, name)
+
+	eventsChannel := make(chan []byte)
+	lostChannel := make(chan uint64)
+	pb, err := bpfModule.InitPerfBuf("events", eventsChannel, lostChannel, 64)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pb.Start()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		pb.Stop()
+		pb.Close()
+		stop()
+	}()
+
+	if !opts.noClear {
+		fmt.Print("\033[H\033[2J")
+	}
+
+loop:
+	for {
+		select {
+		case data := <-eventsChannel:
+			printEvent(data)
+		case e := <-lostChannel:
+			log.Printf("lost %d events", e)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+}
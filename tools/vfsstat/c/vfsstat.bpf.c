@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/vfsstat.bpf.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/vfsstat.c
\ No newline at end of file
@@ -0,0 +1 @@
+../../../bcc/libbpf-tools/vfsstat.h
\ No newline at end of file
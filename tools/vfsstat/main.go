@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	S_READ = iota
+	S_WRITE
+	S_FSYNC
+	S_OPEN
+	S_CREATE
+	S_UNLINK
+	S_MKDIR
+	S_RMDIR
+	S_MAXSTAT
+)
+
+var statTypesNames = [S_MAXSTAT]string{
+	S_READ:   "READ",
+	S_WRITE:  "WRITE",
+	S_FSYNC:  "FSYNC",
+	S_OPEN:   "OPEN",
+	S_CREATE: "CREATE",
+	S_UNLINK: "UNLINK",
+	S_MKDIR:  "MKDIR",
+	S_RMDIR:  "RMDIR",
+}
+
+type Stats struct {
+	Values [S_MAXSTAT]uint64
+}
+
+type Options struct {
+	bpfObjPath string
+	verbose    bool
+	interval   uint64
+	count      uint64
+}
+
+var opts = Options{
+	bpfObjPath: "vfsstat.bpf.o",
+	verbose:    false,
+	interval:   1,
+	count:      99999999,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			count, err := strconv.Atoi(args[1])
+			if err != nil || count <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.count = uint64(count)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+}
+
+func setAutoload(bpfModule *bpf.Module) []string {
+	disabledPrefix := "fentry_"
+	if common.FentryCanAttach("vfs_read") {
+		disabledPrefix = "kprobe_"
+	}
+	var programNames []string
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if !strings.HasPrefix(prog.Name(), disabledPrefix) {
+			programNames = append(programNames, prog.Name())
+			continue
+		}
+		if err := prog.SetAutoload(false); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	return programNames
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module, names []string) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if !common.Contains(names, prog.Name()) {
+			continue
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func printHeader() {
+	fmt.Printf("%-8s  ", "TIME")
+	for _, name := range statTypesNames {
+		fmt.Printf(" %6s/s", name)
+	}
+	fmt.Printf("\n")
+}
+
+func printAndResetStats(bss *bpf.BPFMap) {
+	values, err := common.DumpThenClearArray(bss)
+	if err != nil {
+		log.Fatalf("failed to read stats: %s", err)
+	}
+	var stats Stats
+	if len(values) > 0 {
+		if err := binary.Read(bytes.NewReader(values[0]), binary.LittleEndian, &stats); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	ts := time.Now().Format("15:04:05")
+	fmt.Printf("%-8s: ", ts)
+	for _, v := range stats.Values {
+		fmt.Printf(" %8d", v/opts.interval)
+	}
+	fmt.Printf("\n")
+}
+
+func main() {
+	parseArgs()
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	names := setAutoload(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule, names)
+
+	bss, err := bpfModule.GetMap(".bss")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	count := opts.count
+
+	printHeader()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		printAndResetStats(bss)
+
+		count--
+		if end || count == 0 {
+			break loop
+		}
+	}
+}
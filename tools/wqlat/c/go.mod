@@ -0,0 +1,3 @@
+module github.com/mozillazg/libbpfgo-tools/tools/wqlat/c
+
+go 1.17
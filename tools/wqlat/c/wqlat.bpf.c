@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: GPL-2.0
+#include <vmlinux.h>
+#include <bpf/bpf_core_read.h>
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+#include "wqlat.h"
+#include "bits.bpf.h"
+#include "maps.bpf.h"
+
+#define MAX_ENTRIES	10240
+
+const volatile bool targ_per_func = false;
+const volatile bool targ_ms = false;
+
+/* the workqueue is reported by name on newer kernels, and as a pointer before */
+struct trace_event_raw_workqueue_queue_work___x {
+	u32 __data_loc_workqueue;
+} __attribute__((preserve_access_index));
+
+struct trace_event_raw_workqueue_queue_work___y {
+	void *workqueue;
+} __attribute__((preserve_access_index));
+
+struct start_t {
+	u64 ts;
+	/* the work function, which workqueue_execute_end of older kernels lacks */
+	u64 function;
+	char workqueue[WQ_NAME_LEN];
+};
+
+/* queued works, by their work_struct */
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u64);
+	__type(value, struct start_t);
+} queued SEC(".maps");
+
+/* running works, by the kworker which runs them */
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, u32);
+	__type(value, struct start_t);
+} running SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, struct hist_key);
+	__type(value, struct hist);
+} queue_hists SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, MAX_ENTRIES);
+	__type(key, struct hist_key);
+	__type(value, struct hist);
+} exec_hists SEC(".maps");
+
+static struct hist zero;
+
+static void update_hist(void *hists, struct start_t *start)
+{
+	struct hist_key key = {};
+	struct hist *histp;
+	s64 delta;
+	u64 slot;
+
+	delta = (s64)(bpf_ktime_get_ns() - start->ts);
+	if (delta < 0)
+		return;
+
+	if (targ_per_func)
+		key.function = start->function;
+	else
+		__builtin_memcpy(key.workqueue, start->workqueue, sizeof(key.workqueue));
+
+	histp = bpf_map_lookup_or_try_init(hists, &key, &zero);
+	if (!histp)
+		return;
+
+	if (targ_ms)
+		delta /= 1000000U;
+	else
+		delta /= 1000U;
+	slot = log2l(delta);
+	if (slot >= MAX_SLOTS)
+		slot = MAX_SLOTS - 1;
+	__sync_fetch_and_add(&histp->slots[slot], 1);
+}
+
+SEC("tracepoint/workqueue/workqueue_queue_work")
+int workqueue_queue_work(struct trace_event_raw_workqueue_queue_work *ctx)
+{
+	struct trace_event_raw_workqueue_queue_work___x *ctx_x = (void *)ctx;
+	struct trace_event_raw_workqueue_queue_work___y *ctx_y = (void *)ctx;
+	struct workqueue_struct *wq;
+	struct start_t start = {};
+	u64 key = (u64)ctx->work;
+
+	start.ts = bpf_ktime_get_ns();
+	if (bpf_core_field_exists(ctx_x->__data_loc_workqueue)) {
+		u32 loc = BPF_CORE_READ(ctx_x, __data_loc_workqueue);
+
+		bpf_probe_read_kernel_str(&start.workqueue, sizeof(start.workqueue),
+					  (void *)ctx + (loc & 0xffff));
+	} else {
+		wq = BPF_CORE_READ(ctx_y, workqueue);
+		bpf_core_read_str(&start.workqueue, sizeof(start.workqueue), &wq->name);
+	}
+	bpf_map_update_elem(&queued, &key, &start, BPF_ANY);
+	return 0;
+}
+
+SEC("tracepoint/workqueue/workqueue_execute_start")
+int workqueue_execute_start(struct trace_event_raw_workqueue_execute_start *ctx)
+{
+	u32 tid = (u32)bpf_get_current_pid_tgid();
+	u64 key = (u64)ctx->work;
+	struct start_t *startp;
+	struct start_t start = {};
+
+	startp = bpf_map_lookup_elem(&queued, &key);
+	if (!startp)
+		return 0;
+	startp->function = (u64)ctx->function;
+	update_hist(&queue_hists, startp);
+
+	start.function = startp->function;
+	__builtin_memcpy(start.workqueue, startp->workqueue, sizeof(start.workqueue));
+	bpf_map_delete_elem(&queued, &key);
+	start.ts = bpf_ktime_get_ns();
+	bpf_map_update_elem(&running, &tid, &start, BPF_ANY);
+	return 0;
+}
+
+SEC("tracepoint/workqueue/workqueue_execute_end")
+int workqueue_execute_end(void *ctx)
+{
+	u32 tid = (u32)bpf_get_current_pid_tgid();
+	struct start_t *startp;
+
+	startp = bpf_map_lookup_elem(&running, &tid);
+	if (!startp)
+		return 0;
+	update_hist(&exec_hists, startp);
+	bpf_map_delete_elem(&running, &tid);
+	return 0;
+}
+
+char LICENSE[] SEC("license") = "GPL";
@@ -0,0 +1,17 @@
+/* SPDX-License-Identifier: (LGPL-2.1 OR BSD-2-Clause) */
+#ifndef __WQLAT_H
+#define __WQLAT_H
+
+#define MAX_SLOTS	27
+#define WQ_NAME_LEN	24
+
+struct hist_key {
+	__u64 function;
+	char workqueue[WQ_NAME_LEN];
+};
+
+struct hist {
+	__u32 slots[MAX_SLOTS];
+};
+
+#endif /* __WQLAT_H */
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+	"github.com/mozillazg/libbpfgo-tools/common"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	MAX_SLOTS   = 27
+	WQ_NAME_LEN = 24
+)
+
+type Hist struct {
+	Slots [MAX_SLOTS]uint32
+}
+
+type HistKey struct {
+	Function  uint64
+	Workqueue [WQ_NAME_LEN]byte
+}
+
+type Options struct {
+	bpfObjPath   string
+	verbose      bool
+	timestamp    bool
+	milliseconds bool
+	function     bool
+	interval     uint64
+	times        uint64
+}
+
+var opts = Options{
+	bpfObjPath:   "wqlat.bpf.o",
+	verbose:      false,
+	timestamp:    false,
+	milliseconds: false,
+	function:     false,
+	interval:     99999999,
+	times:        99999999,
+}
+
+func init() {
+	flag.StringVar(&opts.bpfObjPath, "objpath", opts.bpfObjPath, "Path to the bpf object file")
+	flag.BoolVarP(&opts.timestamp, "timestamp", "T", opts.timestamp, "Include timestamp on output")
+	flag.BoolVarP(&opts.milliseconds, "milliseconds", "m", opts.milliseconds, "Millisecond histogram")
+	flag.BoolVarP(&opts.function, "function", "F", opts.function, "Print a histogram per work function instead of per workqueue")
+	// flag.BoolVarP(&opts.verbose, "verbose", "v", opts.verbose, "Verbose debug output")
+}
+
+func parseArgs() {
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		interval, err := strconv.Atoi(args[0])
+		if err != nil || interval <= 0 {
+			log.Fatal("invalid internal\n")
+		}
+		opts.interval = uint64(interval)
+		if len(args) > 1 {
+			times, err := strconv.Atoi(args[1])
+			if err != nil || times <= 0 {
+				log.Fatal("invalid times\n")
+			}
+			opts.times = uint64(times)
+		}
+	}
+}
+
+func initGlobalVars(bpfModule *bpf.Module) {
+	if opts.function {
+		if err := bpfModule.InitGlobalVariable("targ_per_func", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if opts.milliseconds {
+		if err := bpfModule.InitGlobalVariable("targ_ms", true); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func loadBPFObj(bpfModule *bpf.Module) {
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func applyFilters(bpfModule *bpf.Module) {
+}
+
+func attachPrograms(bpfModule *bpf.Module) {
+	progIter := bpfModule.Iterator()
+	for {
+		prog := progIter.NextProgram()
+		if prog == nil {
+			break
+		}
+		if _, err := prog.AttachGeneric(); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+func printLog2Hists(title string, hists *bpf.BPFMap, ksyms *common.Ksyms) {
+	units := "usecs"
+	if opts.milliseconds {
+		units = "msecs"
+	}
+	items, err := common.DumpThenClearHash(hists)
+	if err != nil {
+		log.Fatalf("failed to dump hists: %s", err)
+	}
+	fmt.Printf("%s:\n", title)
+	for _, item := range items {
+		var key HistKey
+		if err := binary.Read(bytes.NewReader(item[0]), binary.LittleEndian, &key); err != nil {
+			log.Fatalln(err)
+		}
+		var hist Hist
+		if err := binary.Read(bytes.NewReader(item[1]), binary.LittleEndian, &hist); err != nil {
+			log.Fatalln(err)
+		}
+
+		var vals []int
+		for _, v := range hist.Slots {
+			vals = append(vals, int(v))
+		}
+		if opts.function {
+			name := fmt.Sprintf("%#x", key.Function)
+			if k := ksyms.MapAddr(key.Function); k != nil {
+				name = k.Name
+			}
+			fmt.Printf("\nfunction = %s\n", name)
+		} else {
+			fmt.Printf("\nworkqueue = %s\n", common.GoString(key.Workqueue[:]))
+		}
+		common.PrintLog2Hist(vals, units)
+	}
+	fmt.Printf("\n")
+}
+
+func main() {
+	parseArgs()
+
+	ksyms, err := common.LoadKsyms()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	bpfModule, err := bpf.NewModuleFromFile(opts.bpfObjPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer bpfModule.Close()
+
+	initGlobalVars(bpfModule)
+	loadBPFObj(bpfModule)
+	applyFilters(bpfModule)
+	attachPrograms(bpfModule)
+
+	queueHists, err := bpfModule.GetMap("queue_hists")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	execHists, err := bpfModule.GetMap("exec_hists")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer func() {
+		stop()
+	}()
+	ticker := time.NewTicker(time.Second * time.Duration(opts.interval))
+	var end bool
+	times := opts.times
+	fmt.Printf("Tracing workqueue latency... Hit Ctrl-C to end.\n")
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			end = true
+			break
+		case <-ticker.C:
+			break
+		}
+
+		fmt.Printf("\n")
+		if opts.timestamp {
+			ts := time.Now().Format("15:04:05")
+			fmt.Printf("%-8s\n", ts)
+		}
+		printLog2Hists("queue latency", queueHists, ksyms)
+		printLog2Hists("execution time", execHists, ksyms)
+
+		times--
+		if end || times == 0 {
+			break loop
+		}
+	}
+}